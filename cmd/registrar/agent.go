@@ -31,29 +31,89 @@ var agentCommand = &cli.Command{
 			Value: "/etc/containerd/certs.d",
 		},
 		&cli.GenericFlag{
-			Name:     "containerd-cri-registry-files",
-			Usage:    "files to copy to containerd cri registry path",
-			Value:    flags.NewFileSlice(),
-			Required: true,
+			Name:  "containerd-cri-registry-files",
+			Usage: "files to copy to containerd cri registry path",
+			Value: flags.NewFileSlice(),
+		},
+		&cli.StringFlag{
+			Name:  "state-file",
+			Usage: "path to the file recording the changes to be reverted on uninstall",
+			Value: "/etc/containerd/containerd-registrar.json",
+		},
+		&cli.BoolFlag{
+			Name:  "uninstall",
+			Usage: "revert the changes recorded in the state file instead of configuring containerd",
 		},
 		&cli.DurationFlag{
 			Name:  "restart.timeout",
 			Usage: "containerd restart timeout",
 			Value: 30 * time.Second,
 		},
+		&cli.IntFlag{
+			Name:  "restart.slots",
+			Usage: "number of containerd restarts allowed concurrently across the cluster, 0 disables limit",
+			Value: 0,
+		},
+		&cli.DurationFlag{
+			Name:  "restart.slot-duration",
+			Usage: "duration after which a restart slot of a crashed agent expires",
+			Value: time.Minute,
+		},
+		&cli.StringFlag{
+			Name:    "node-name",
+			Usage:   "name of the node the agent is running on",
+			EnvVars: []string{"NODE_NAME"},
+		},
+		&cli.StringFlag{
+			Name:    "namespace",
+			Usage:   "namespace the agent is running in",
+			EnvVars: []string{"POD_NAMESPACE"},
+			Value:   "kube-system",
+		},
+		&cli.GenericFlag{
+			Name:  "kubeconfig",
+			Usage: "kubernetes config filepath",
+			Value: flags.NewFile(""),
+		},
 	},
 	Action: func(ctx *cli.Context) error {
 		logrus.SetLevel(ctx.Value("log.level").(logrus.Level))
 
-		mgr := agent.NewManager(agent.Config{
+		if ctx.Int("restart.slots") > 0 && ctx.String("node-name") == "" {
+			logrus.Fatal("node name is required when limiting concurrent restarts")
+		}
+
+		if !ctx.Bool("uninstall") && len(ctx.Value("containerd-cri-registry-files").([]string)) == 0 {
+			logrus.Fatal("containerd cri registry files are required")
+		}
+
+		file := ctx.Value("kubeconfig").(string)
+		clientset, err := newClientset(file)
+		if err != nil {
+			logrus.WithField("kubeconfig", file).WithError(err).Fatal("building kubernetes clientset")
+		}
+
+		mgr := agent.NewManager(clientset, agent.Config{
 			BinaryName:     ctx.String("containerd-binary"),
 			ConfigFile:     ctx.String("containerd-config-file"),
 			RegistryPath:   ctx.String("containerd-cri-registry-path"),
 			RegistryHosts:  ctx.Value("containerd-cri-registry-files").([]string),
-			RestartTimeout: ctx.Duration("restart.timout"),
+			RestartTimeout: ctx.Duration("restart.timeout"),
+			StateFile:      ctx.String("state-file"),
+
+			NodeName:            ctx.String("node-name"),
+			Namespace:           ctx.String("namespace"),
+			RestartSlots:        ctx.Int("restart.slots"),
+			RestartSlotDuration: ctx.Duration("restart.slot-duration"),
 		})
 
-		logrus.WithFields(logrus.Fields{"version": version.Version, "revision": version.Revision}).Info("running containerd-registrar agent")
+		logfields := logrus.Fields{"version": version.Version, "revision": version.Revision}
+		if ctx.Bool("uninstall") {
+			logrus.WithFields(logfields).Info("uninstalling containerd-registrar agent")
+			return mgr.Uninstall(ctx.Context)
+		}
+
+		logrus.WithFields(logfields).Info("running containerd-registrar agent")
 		return mgr.Run(ctx.Context)
 	},
 }
@@ -1,16 +1,21 @@
 package main
 
 import (
+	"net/http"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/metadata"
 
 	"github.com/xinau/containerd-registrar/internal/controller"
 	"github.com/xinau/containerd-registrar/internal/flags"
 	"github.com/xinau/containerd-registrar/internal/version"
+	"github.com/xinau/containerd-registrar/internal/webhook"
 )
 
 var controllerCommand = &cli.Command{
@@ -27,6 +32,29 @@ var controllerCommand = &cli.Command{
 			Usage: "key of agent taint applied to nodes",
 			Value: "node.containerd-registrar.io/agent-not-ready",
 		},
+		&cli.StringFlag{
+			Name:  "agent-node-taint-value",
+			Usage: "value of agent taint applied to nodes",
+			Value: "true",
+		},
+		&cli.StringFlag{
+			Name:  "agent-node-taint-effect",
+			Usage: "effect of agent taint applied to nodes, either NoSchedule, PreferNoSchedule or NoExecute evicting non-tolerating pods",
+			Value: string(corev1.TaintEffectNoSchedule),
+		},
+		&cli.StringSliceFlag{
+			Name:  "exempt-namespaces",
+			Usage: "namespaces whose pods get a toleration added before a NoExecute agent taint is applied",
+		},
+		&cli.StringSliceFlag{
+			Name:  "exempt-priority-classes",
+			Usage: "priority classes whose pods get a toleration added before a NoExecute agent taint is applied",
+			Value: cli.NewStringSlice("system-node-critical", "system-cluster-critical"),
+		},
+		&cli.StringFlag{
+			Name:  "autoscaler-compat",
+			Usage: "autoscaler the agent taint is made compatible with, either cluster-autoscaler rewriting the taint key to a startup-taint or karpenter",
+		},
 		&cli.StringFlag{
 			Name:  "agent-pod-namespace",
 			Usage: "namespace to containing registrar agent pods",
@@ -42,6 +70,160 @@ var controllerCommand = &cli.Command{
 			Usage: "kubernetes informer resync interval duration",
 			Value: time.Minute,
 		},
+		&cli.IntFlag{
+			Name:  "controller-workers",
+			Usage: "number of workers reconciling nodes concurrently",
+			Value: 2,
+		},
+		&cli.StringFlag{
+			Name:  "metrics-listen-address",
+			Usage: "address to listen on for serving metrics",
+			Value: ":9090",
+		},
+		&cli.GenericFlag{
+			Name:  "rollout-max-unavailable",
+			Usage: "maximum number of nodes or percentage of nodes unavailable during agent rollout",
+			Value: flags.NewIntOrPercent("1"),
+		},
+		&cli.IntFlag{
+			Name:  "rollout-max-unavailable-per-zone",
+			Usage: "maximum number of nodes per zone unavailable during agent rollout, 0 disables limit",
+			Value: 0,
+		},
+		&cli.DurationFlag{
+			Name:  "rollout-ready-timeout",
+			Usage: "duration a node has to become ready during agent rollout before pausing the rollout",
+			Value: 5 * time.Minute,
+		},
+		&cli.GenericFlag{
+			Name:  "canary-node-labels",
+			Usage: "label matching canary nodes receiving a new agent revision first",
+			Value: flags.NewLabelSelector(""),
+		},
+		&cli.IntFlag{
+			Name:  "canary-percentage",
+			Usage: "percentage of nodes receiving a new agent revision first, if no canary node labels are set",
+			Value: 0,
+		},
+		&cli.DurationFlag{
+			Name:  "canary-bake-time",
+			Usage: "duration canary nodes have to stay healthy before promoting a new agent revision",
+			Value: 10 * time.Minute,
+		},
+		&cli.IntFlag{
+			Name:  "canary-max-pull-failures",
+			Usage: "maximum number of image pull failures on canary nodes before rolling back a new agent revision",
+			Value: 0,
+		},
+		&cli.IntFlag{
+			Name:  "config-revision-history-limit",
+			Usage: "number of registry config revisions kept, 0 keeps all revisions",
+			Value: 10,
+		},
+		&cli.DurationFlag{
+			Name:  "pending-timeout",
+			Usage: "duration a node's agent has to become ready before applying the pending timeout policy, 0 disables timeout",
+			Value: 0,
+		},
+		&cli.StringFlag{
+			Name:  "pending-timeout-policy",
+			Usage: "policy applied to nodes exceeding the pending timeout, either fail-closed keeping or fail-open removing the agent taint",
+			Value: controller.PendingTimeoutPolicyFailClosed,
+		},
+		&cli.StringFlag{
+			Name:  "node-state-label",
+			Usage: "key of label mirroring the node state, empty disables label",
+			Value: "node.containerd-registrar.io/node-state",
+		},
+		&cli.IntFlag{
+			Name:  "node-state-history-limit",
+			Usage: "number of state transitions recorded on each node, 0 disables history",
+			Value: 10,
+		},
+		&cli.BoolFlag{
+			Name:  "agent-daemonset-managed",
+			Usage: "create and update the agent daemonset from the controller's config",
+		},
+		&cli.StringFlag{
+			Name:  "agent-daemonset-name",
+			Usage: "name of the agent daemonset managed by the controller",
+			Value: "containerd-registrar-agent",
+		},
+		&cli.StringFlag{
+			Name:  "agent-image",
+			Usage: "image of the agent managed by the controller",
+			Value: "xinau/containerd-registrar:latest",
+		},
+		&cli.StringFlag{
+			Name:  "agent-pause-image",
+			Usage: "image of the pause container keeping the agent pods running",
+			Value: "gcr.io/google-containers/pause:3.2",
+		},
+		&cli.StringFlag{
+			Name:  "agent-service-account",
+			Usage: "service account of the agent managed by the controller",
+			Value: "containerd-registrar-agent",
+		},
+		&cli.StringFlag{
+			Name:  "agent-registry-configmap",
+			Usage: "name of the configmap containing the registry hosts files",
+			Value: "containerd-registrar-registries",
+		},
+		&cli.StringSliceFlag{
+			Name:  "agent-registry-files",
+			Usage: "keys of the registry configmap copied to containerd cri registry path",
+			Value: cli.NewStringSlice("hosts.toml"),
+		},
+		&cli.IntFlag{
+			Name:  "agent-restart-slots",
+			Usage: "number of containerd restarts allowed concurrently across the cluster, 0 disables limit",
+			Value: 3,
+		},
+		&cli.BoolFlag{
+			Name:  "break-glass",
+			Usage: "release all gated nodes and stop tainting nodes",
+		},
+		&cli.StringFlag{
+			Name:  "break-glass-configmap",
+			Usage: "name of the configmap in the agent pod namespace whose break-glass annotation releases all gated nodes, empty disables",
+			Value: "containerd-registrar-break-glass",
+		},
+		&cli.StringFlag{
+			Name:  "webhook-listen-address",
+			Usage: "address to listen on for serving the toleration injecting webhook, empty disables webhook",
+		},
+		&cli.StringFlag{
+			Name:  "webhook-tls-cert-file",
+			Usage: "path to the webhook's TLS certificate",
+			Value: "/etc/containerd-registrar/webhook/tls.crt",
+		},
+		&cli.StringFlag{
+			Name:  "webhook-tls-key-file",
+			Usage: "path to the webhook's TLS private key",
+			Value: "/etc/containerd-registrar/webhook/tls.key",
+		},
+		&cli.StringSliceFlag{
+			Name:  "webhook-namespaces",
+			Usage: "namespaces whose pods get the agent taint toleration injected",
+		},
+		&cli.StringSliceFlag{
+			Name:  "webhook-priority-classes",
+			Usage: "priority classes whose pods get the agent taint toleration injected",
+		},
+		&cli.StringSliceFlag{
+			Name:  "webhook-daemonsets",
+			Usage: "daemonsets given as namespace/name, or * for all, whose pods get the agent taint toleration injected",
+		},
+		&cli.Float64Flag{
+			Name:  "kube-api-qps",
+			Usage: "maximum queries per second to the kubernetes api server",
+			Value: 20,
+		},
+		&cli.IntFlag{
+			Name:  "kube-api-burst",
+			Usage: "maximum burst of queries to the kubernetes api server",
+			Value: 30,
+		},
 		&cli.GenericFlag{
 			Name:  "kubeconfig",
 			Usage: "kubernetes config filepath",
@@ -51,27 +233,127 @@ var controllerCommand = &cli.Command{
 	Action: func(ctx *cli.Context) error {
 		logrus.SetLevel(ctx.Value("log.level").(logrus.Level))
 
-		// if kubeconfig is empty, in-cluster config will be used
+		if pct := ctx.Int("canary-percentage"); pct < 0 || pct > 100 {
+			logrus.WithField("percentage", pct).Fatal("canary percentage out of range 0-100")
+		}
+
+		switch policy := ctx.String("pending-timeout-policy"); policy {
+		case controller.PendingTimeoutPolicyFailClosed, controller.PendingTimeoutPolicyFailOpen:
+		default:
+			logrus.WithField("policy", policy).Fatal("unknown pending timeout policy")
+		}
+
+		switch effect := corev1.TaintEffect(ctx.String("agent-node-taint-effect")); effect {
+		case corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+		default:
+			logrus.WithField("effect", effect).Fatal("unknown agent taint effect")
+		}
+
+		compat := ctx.String("autoscaler-compat")
+		taint, err := controller.EffectiveAgentNodeTaint(ctx.String("agent-node-taint"), compat)
+		if err != nil {
+			logrus.WithField("autoscaler-compat", compat).WithError(err).Fatal("validating agent taint")
+		}
+
+		if taint != ctx.String("agent-node-taint") {
+			logrus.WithFields(logrus.Fields{"taint": ctx.String("agent-node-taint"), "taint.effective": taint, "autoscaler-compat": compat}).Warn("rewriting agent taint key for autoscaler compatibility")
+		}
+
 		file := ctx.Value("kubeconfig").(string)
-		config, err := clientcmd.BuildConfigFromFlags("", file)
+		config, err := newConfig(file)
 		if err != nil {
-			logrus.WithField("kubeconfig", file).WithError(err).Fatal("building kubernets config")
+			logrus.WithField("kubeconfig", file).WithError(err).Fatal("building kubernetes config")
 		}
 
+		config.QPS = float32(ctx.Float64("kube-api-qps"))
+		config.Burst = ctx.Int("kube-api-burst")
+
 		clientset, err := kubernetes.NewForConfig(config)
 		if err != nil {
-			logrus.WithError(err).Fatal("getting kubernets config")
+			logrus.WithError(err).Fatal("building kubernetes clientset")
 		}
 
-		mgr := controller.NewManager(clientset, controller.Config{
+		metaclient, err := metadata.NewForConfig(config)
+		if err != nil {
+			logrus.WithError(err).Fatal("building kubernetes metadata client")
+		}
+
+		mgr := controller.NewManager(clientset, metaclient, controller.Config{
 			AgentNodeLabels:   ctx.String("agent-node-labels"),
-			AgentNodeTaint:    ctx.String("agent-node-taint"),
+			AgentNodeTaint:    taint,
 			AgentPodNamespace: ctx.String("agent-pod-namespace"),
 			AgentPodLabels:    ctx.String("agent-pod-labels"),
 			ResyncInterval:    ctx.Duration("controller-resync-interval"),
+			Workers:           ctx.Int("controller-workers"),
+
+			AgentNodeTaintValue:  ctx.String("agent-node-taint-value"),
+			AgentNodeTaintEffect: corev1.TaintEffect(ctx.String("agent-node-taint-effect")),
+
+			RolloutMaxUnavailable:        intstr.Parse(ctx.String("rollout-max-unavailable")),
+			RolloutMaxUnavailablePerZone: ctx.Int("rollout-max-unavailable-per-zone"),
+			RolloutReadyTimeout:          ctx.Duration("rollout-ready-timeout"),
+
+			CanaryNodeLabels:      ctx.String("canary-node-labels"),
+			CanaryPercentage:      ctx.Int("canary-percentage"),
+			CanaryBakeTime:        ctx.Duration("canary-bake-time"),
+			CanaryMaxPullFailures: ctx.Int("canary-max-pull-failures"),
+
+			ConfigRevisionHistoryLimit: ctx.Int("config-revision-history-limit"),
+
+			PendingTimeout:       ctx.Duration("pending-timeout"),
+			PendingTimeoutPolicy: ctx.String("pending-timeout-policy"),
+
+			NodeStateLabel:        ctx.String("node-state-label"),
+			NodeStateHistoryLimit: ctx.Int("node-state-history-limit"),
+
+			ExemptNamespaces:      ctx.StringSlice("exempt-namespaces"),
+			ExemptPriorityClasses: ctx.StringSlice("exempt-priority-classes"),
+
+			AgentDaemonSetManaged:  ctx.Bool("agent-daemonset-managed"),
+			AgentDaemonSetName:     ctx.String("agent-daemonset-name"),
+			AgentImage:             ctx.String("agent-image"),
+			AgentPauseImage:        ctx.String("agent-pause-image"),
+			AgentServiceAccount:    ctx.String("agent-service-account"),
+			AgentRegistryConfigMap: ctx.String("agent-registry-configmap"),
+			AgentRegistryFiles:     ctx.StringSlice("agent-registry-files"),
+			AgentRestartSlots:      ctx.Int("agent-restart-slots"),
+
+			BreakGlass:          ctx.Bool("break-glass"),
+			BreakGlassConfigMap: ctx.String("break-glass-configmap"),
 		})
 
-		logrus.WithFields(logrus.Fields{"version": version.Version, "revision": version.Revision}).Info("running containerd-registrar controller")
+		addr := ctx.String("metrics-listen-address")
+		go func() {
+			http.Handle("/metrics", promhttp.Handler())
+			if err := http.ListenAndServe(addr, nil); err != nil {
+				logrus.WithField("address", addr).WithError(err).Fatal("serving metrics")
+			}
+		}()
+
+		if addr := ctx.String("webhook-listen-address"); addr != "" {
+			handler := webhook.NewHandler(webhook.Config{
+				TaintKey:        taint,
+				Namespaces:      ctx.StringSlice("webhook-namespaces"),
+				PriorityClasses: ctx.StringSlice("webhook-priority-classes"),
+				DaemonSets:      ctx.StringSlice("webhook-daemonsets"),
+			})
+
+			go func() {
+				mux := http.NewServeMux()
+				mux.Handle("/mutate", handler)
+				err := http.ListenAndServeTLS(addr, ctx.String("webhook-tls-cert-file"), ctx.String("webhook-tls-key-file"), mux)
+				if err != nil {
+					logrus.WithField("address", addr).WithError(err).Fatal("serving webhook")
+				}
+			}()
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"version":           version.Version,
+			"revision":          version.Revision,
+			"taint":             taint,
+			"autoscaler-compat": compat,
+		}).Info("running containerd-registrar controller")
 		return mgr.Run(ctx.Context)
 	},
 }
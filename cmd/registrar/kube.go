@@ -0,0 +1,23 @@
+package main
+
+import (
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// newConfig returns a kubernetes client config for the given kubeconfig file.
+// If file is empty, in-cluster config will be used.
+func newConfig(file string) (*rest.Config, error) {
+	return clientcmd.BuildConfigFromFlags("", file)
+}
+
+// newClientset returns a kubernetes clientset for the given kubeconfig file.
+func newClientset(file string) (*kubernetes.Clientset, error) {
+	config, err := newConfig(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return kubernetes.NewForConfig(config)
+}
@@ -41,6 +41,9 @@ func App() *cli.App {
 	app.Commands = []*cli.Command{
 		agentCommand,
 		controllerCommand,
+		teardownCommand,
+		rollbackCommand,
+		statusCommand,
 	}
 	return app
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+
+	"github.com/xinau/containerd-registrar/internal/controller"
+	"github.com/xinau/containerd-registrar/internal/flags"
+)
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+var rollbackCommand = &cli.Command{
+	Name:  "rollback",
+	Usage: "list or restore revisions of the agent's registry config",
+	Flags: []cli.Flag{
+		&cli.Int64Flag{
+			Name:  "to-revision",
+			Usage: "revision of the registry config to restore, 0 lists all revisions",
+		},
+		&cli.StringFlag{
+			Name:  "agent-pod-namespace",
+			Usage: "namespace containing the agent's registry config",
+			Value: "kube-system",
+		},
+		&cli.GenericFlag{
+			Name:  "kubeconfig",
+			Usage: "kubernetes config filepath",
+			Value: flags.NewFile(""),
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		logrus.SetLevel(ctx.Value("log.level").(logrus.Level))
+
+		file := ctx.Value("kubeconfig").(string)
+		clientset, err := newClientset(file)
+		if err != nil {
+			logrus.WithField("kubeconfig", file).WithError(err).Fatal("building kubernetes clientset")
+		}
+
+		namespace := ctx.String("agent-pod-namespace")
+		if revision := ctx.Int64("to-revision"); revision != 0 {
+			rev, err := controller.Rollback(ctx.Context, clientset, namespace, revision)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("restored revision %d (%s) of configmaps %s\n", rev.Revision, rev.Hash, strings.Join(rev.ConfigMaps, ", "))
+			return nil
+		}
+
+		revs, err := controller.ListConfigRevisions(ctx.Context, clientset, namespace)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "REVISION\tHASH\tRESULT\tCREATED\tUPDATED")
+		for _, rev := range revs {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", rev.Revision, rev.Hash, rev.Result, formatTime(rev.Created), formatTime(rev.Updated))
+		}
+		return w.Flush()
+	},
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+
+	"github.com/xinau/containerd-registrar/internal/controller"
+	"github.com/xinau/containerd-registrar/internal/flags"
+)
+
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return d.Round(time.Second).String()
+}
+
+func formatReason(reason string) string {
+	if reason == "" {
+		return "-"
+	}
+	return reason
+}
+
+var statusCommand = &cli.Command{
+	Name:  "status",
+	Usage: "show the registrar state of nodes and their state history",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "node",
+			Usage: "name of node whose state history is shown, empty lists all managed nodes",
+		},
+		&cli.GenericFlag{
+			Name:  "kubeconfig",
+			Usage: "kubernetes config filepath",
+			Value: flags.NewFile(""),
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		logrus.SetLevel(ctx.Value("log.level").(logrus.Level))
+
+		file := ctx.Value("kubeconfig").(string)
+		clientset, err := newClientset(file)
+		if err != nil {
+			logrus.WithField("kubeconfig", file).WithError(err).Fatal("building kubernetes clientset")
+		}
+
+		statuses, err := controller.ListNodeStatus(ctx.Context, clientset, ctx.String("node"))
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		if ctx.String("node") == "" {
+			fmt.Fprintln(w, "NODE\tSTATE\tREASON\tSINCE\tTIME-TO-READY")
+			for _, status := range statuses {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", status.Name, status.State, formatReason(status.Reason),
+					formatTime(status.Since), formatDuration(status.TimeToReady))
+			}
+			return w.Flush()
+		}
+
+		status := statuses[0]
+		fmt.Printf("node: %s, state: %s, time-to-ready: %s\n", status.Name, status.State, formatDuration(status.TimeToReady))
+		fmt.Fprintln(w, "TIMESTAMP\tSTATE\tREASON\tDURATION")
+		for i, transition := range status.History {
+			until := time.Now()
+			if i+1 < len(status.History) {
+				until = status.History[i+1].Timestamp
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", formatTime(transition.Timestamp), transition.State,
+				formatReason(transition.Reason), formatDuration(until.Sub(transition.Timestamp)))
+		}
+		return w.Flush()
+	},
+}
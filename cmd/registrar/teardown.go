@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+
+	"github.com/xinau/containerd-registrar/internal/controller"
+	"github.com/xinau/containerd-registrar/internal/flags"
+)
+
+var teardownCommand = &cli.Command{
+	Name:  "teardown",
+	Usage: "remove all registrar state from the cluster's nodes",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "agent-node-taint",
+			Usage: "key of agent taint applied to nodes",
+			Value: "node.containerd-registrar.io/agent-not-ready",
+		},
+		&cli.StringFlag{
+			Name:  "autoscaler-compat",
+			Usage: "autoscaler the agent taint was made compatible with, either cluster-autoscaler or karpenter",
+		},
+		&cli.StringFlag{
+			Name:  "node-state-label",
+			Usage: "key of label mirroring the node state",
+			Value: "node.containerd-registrar.io/node-state",
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "only print nodes which would be changed",
+		},
+		&cli.GenericFlag{
+			Name:  "kubeconfig",
+			Usage: "kubernetes config filepath",
+			Value: flags.NewFile(""),
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		logrus.SetLevel(ctx.Value("log.level").(logrus.Level))
+
+		compat := ctx.String("autoscaler-compat")
+		taint, err := controller.EffectiveAgentNodeTaint(ctx.String("agent-node-taint"), compat)
+		if err != nil {
+			logrus.WithField("autoscaler-compat", compat).WithError(err).Fatal("validating agent taint")
+		}
+
+		file := ctx.Value("kubeconfig").(string)
+		clientset, err := newClientset(file)
+		if err != nil {
+			logrus.WithField("kubeconfig", file).WithError(err).Fatal("building kubernetes clientset")
+		}
+
+		summary, err := controller.Teardown(ctx.Context, clientset, controller.TeardownConfig{
+			AgentNodeTaint: taint,
+			NodeStateLabel: ctx.String("node-state-label"),
+		}, ctx.Bool("dry-run"))
+		if err != nil {
+			return err
+		}
+
+		verb := "released"
+		if ctx.Bool("dry-run") {
+			verb = "would be released"
+		}
+		fmt.Printf("nodes: %d, %s: %d, failed: %d\n", summary.Nodes, verb, summary.Released, summary.Failed)
+
+		if summary.Failed > 0 {
+			return fmt.Errorf("failed releasing %d nodes", summary.Failed)
+		}
+		return nil
+	},
+}
@@ -3,11 +3,17 @@ package agent
 import (
 	"context"
 	"fmt"
+	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
 
 	"github.com/xinau/containerd-registrar/internal/containerd"
+	"github.com/xinau/containerd-registrar/internal/result"
+	"github.com/xinau/containerd-registrar/internal/slots"
 )
 
 type Config struct {
@@ -16,72 +22,318 @@ type Config struct {
 	RegistryPath   string
 	RegistryHosts  []string
 	RestartTimeout time.Duration
+	StateFile      string
+
+	NodeName            string
+	Namespace           string
+	RestartSlots        int
+	RestartSlotDuration time.Duration
 }
 
 type Manager struct {
-	cfg Config
+	client   kubernetes.Interface
+	cfg      Config
+	recorder *recorder
 }
 
-func NewManager(cfg Config) *Manager {
+func NewManager(client kubernetes.Interface, cfg Config) *Manager {
 	return &Manager{
-		cfg: cfg,
+		client: client,
+		cfg:    cfg,
+		recorder: &recorder{
+			client:   client,
+			nodeName: cfg.NodeName,
+		},
+	}
+}
+
+// report writes the result of the agent's run onto its node.
+func (mgr *Manager) report(ctx context.Context, res result.Result, message string) {
+	logfields := logrus.Fields{"node": mgr.cfg.NodeName, "result": res}
+	if mgr.cfg.NodeName == "" {
+		logrus.WithFields(logfields).Debug("node name not set, skipping reporting result")
+		return
+	}
+
+	if err := result.Report(ctx, mgr.client, mgr.cfg.NodeName, res, message); err != nil {
+		logrus.WithFields(logfields).WithError(err).Warn("reporting result to node")
 	}
 }
 
-func (mgr *Manager) copyRegistryHosts() {
+// fail reports the failed result, records it as event and exits.
+func (mgr *Manager) fail(ctx context.Context, res result.Result, logfields logrus.Fields, err error, message string) {
+	mgr.report(ctx, res, fmt.Sprintf("%s: %s", message, err))
+	mgr.recorder.Eventf(ctx, corev1.EventTypeWarning, res.Reason(), "Failed %s: %s", message, err)
+	logrus.WithFields(logfields).WithError(err).Fatal(message)
+}
+
+func (mgr *Manager) copyRegistryHosts(ctx context.Context) {
 	logfields := logrus.Fields{"registry.hosts": mgr.cfg.RegistryHosts, "registry.path": mgr.cfg.RegistryPath}
 	logrus.WithFields(logfields).Debug("copying registry hosts to path")
 	if err := containerd.CopyRegistryHosts(mgr.cfg.RegistryPath, mgr.cfg.RegistryHosts); err != nil {
-		logrus.WithFields(logfields).WithError(err).Fatal("copying registry hosts to path")
+		mgr.fail(ctx, result.ConfigInvalid, logfields, err, "copying registry hosts to path")
 	}
 	logrus.WithFields(logfields).Info("registry hosts copied to path")
 }
 
-func (mgr *Manager) updateRegistryPath() (bool, error) {
+// updateRegistryPath sets the registry path in containerd's config. If the
+// config changed, the previous content of the config file is returned.
+func (mgr *Manager) updateRegistryPath() ([]byte, bool, error) {
+	backup, err := os.ReadFile(mgr.cfg.ConfigFile)
+	if err != nil {
+		return nil, false, fmt.Errorf("reading config: %s", err)
+	}
+
 	cfg, err := containerd.LoadConfig(mgr.cfg.ConfigFile)
 	if err != nil {
-		return false, fmt.Errorf("loading config: %s", err)
+		return nil, false, fmt.Errorf("loading config: %s", err)
 	}
 
 	changed, err := containerd.SetRegistryPath(cfg, mgr.cfg.RegistryPath)
 	if err != nil {
-		return false, fmt.Errorf("setting registry path in config: %s", err)
+		return nil, false, fmt.Errorf("setting registry path in config: %s", err)
 	}
 
 	if !changed {
-		return false, nil
+		return nil, false, nil
 	}
 
 	if err := containerd.WriteConfig(cfg, mgr.cfg.ConfigFile); err != nil {
-		return true, fmt.Errorf("writting config to file: %s", err)
+		return nil, true, fmt.Errorf("writting config to file: %s", err)
 	}
 
-	return true, nil
+	return backup, true, nil
+}
+
+func (mgr *Manager) restartProcess(ctx context.Context) error {
+	slot := mgr.acquireRestartSlot(ctx)
+	defer mgr.releaseRestartSlot(ctx, slot)
+
+	return containerd.RestartProcess(ctx, mgr.cfg.BinaryName, mgr.cfg.RestartTimeout)
+}
+
+// rollbackConfig restores the previous config file and restarts containerd.
+func (mgr *Manager) rollbackConfig(ctx context.Context, backup []byte) error {
+	if err := os.WriteFile(mgr.cfg.ConfigFile, backup, 0644); err != nil {
+		return fmt.Errorf("restoring config file: %s", err)
+	}
+
+	return mgr.restartProcess(ctx)
+}
+
+// restartOrRollback restarts containerd and restores the previous config, if
+// the restart fails. It reports whether containerd runs with the new config.
+func (mgr *Manager) restartOrRollback(ctx context.Context, backup []byte) bool {
+	logfields := logrus.Fields{"binary.name": mgr.cfg.BinaryName}
+	logrus.WithFields(logfields).Info("restarting containerd process")
+	if err := mgr.restartProcess(ctx); err != nil {
+		logrus.WithFields(logfields).WithError(err).Warn("restarting containerd process, rolling back config")
+		if rbErr := mgr.rollbackConfig(ctx, backup); rbErr != nil {
+			mgr.fail(ctx, result.RestartFailed, logfields, rbErr, "rolling back config")
+		}
+
+		logrus.WithFields(logfields).Warn("config rolled back and containerd process restarted")
+		mgr.report(ctx, result.RolledBack, fmt.Sprintf("restarting containerd process: %s", err))
+		mgr.recorder.Eventf(ctx, corev1.EventTypeWarning, result.RolledBack.Reason(), "Rolled back containerd config after failed restart: %s", err)
+		return false
+	}
+	logrus.WithFields(logfields).Info("containerd process restarted")
+	mgr.recorder.Eventf(ctx, corev1.EventTypeNormal, reasonContainerdRestarted, "Restarted containerd process %s", mgr.cfg.BinaryName)
+
+	return true
 }
 
 func (mgr *Manager) updateRegistryPathAndRestart(ctx context.Context) {
 	logfields := logrus.Fields{"config.file": mgr.cfg.ConfigFile, "registry.path": mgr.cfg.RegistryPath}
 	logrus.WithFields(logfields).Debug("updating registry path in config")
-	changed, err := mgr.updateRegistryPath()
+	backup, changed, err := mgr.updateRegistryPath()
 	if err != nil {
-		logrus.WithFields(logfields).WithError(err).Fatal("updating registry path in config")
+		mgr.fail(ctx, result.ConfigInvalid, logfields, err, "updating registry path in config")
 	}
 
 	if !changed {
+		mgr.report(ctx, result.Success, "registry path already set in config")
 		return
 	}
 	logrus.WithFields(logfields).Info("registry path updated in config")
+	mgr.recorder.Eventf(ctx, corev1.EventTypeNormal, reasonConfigChanged, "Set containerd registry config path to %s", mgr.cfg.RegistryPath)
 
-	logfields = logrus.Fields{"binary.name": mgr.cfg.BinaryName}
-	logrus.WithFields(logfields).Info("restarting containerd process")
-	if err := containerd.RestartProcess(ctx, mgr.cfg.BinaryName, mgr.cfg.RestartTimeout); err != nil {
-		logrus.WithFields(logfields).WithError(err).Fatal("restarting containerd process")
+	if mgr.restartOrRollback(ctx, backup) {
+		mgr.report(ctx, result.Success, "registry path updated in config")
 	}
-	logrus.WithFields(logfields).Info("containerd process restarted")
+}
+
+// recordState records the registry table before the agent changes containerd's
+// config for the first time and the registry hosts installed by the agent.
+func (mgr *Manager) recordState(ctx context.Context) {
+	if mgr.cfg.StateFile == "" {
+		return
+	}
+
+	logfields := logrus.Fields{"state.file": mgr.cfg.StateFile}
+	s, err := loadState(mgr.cfg.StateFile)
+	if err != nil {
+		mgr.fail(ctx, result.ConfigInvalid, logfields, err, "loading state")
+	}
+
+	if s == nil {
+		cfg, err := containerd.LoadConfig(mgr.cfg.ConfigFile)
+		if err != nil {
+			mgr.fail(ctx, result.ConfigInvalid, logfields, err, "loading config")
+		}
+
+		registry, err := containerd.GetRegistry(cfg)
+		if err != nil {
+			mgr.fail(ctx, result.ConfigInvalid, logfields, err, "getting registry table from config")
+		}
+		s = &state{Registry: registry}
+
+		// the registry table of a config already using the registry path was
+		// set by a previous agent, so the original one is unknown.
+		if path := containerd.GetRegistryPath(cfg); path == mgr.cfg.RegistryPath {
+			logrus.WithFields(logfields).WithField("registry.path", path).Warn("registry path already configured, registry table won't be restored on uninstall")
+			s = &state{RegistryUnknown: true}
+		}
+	}
+
+	for _, file := range mgr.cfg.RegistryHosts {
+		name := filepath.Base(file)
+		if s.hasFile(name) {
+			continue
+		}
+
+		// files which existed before the agent installed them are kept on
+		// uninstall.
+		if _, err := os.Stat(filepath.Join(mgr.cfg.RegistryPath, name)); err == nil {
+			continue
+		}
+		s.Files = append(s.Files, name)
+	}
+
+	if err := saveState(mgr.cfg.StateFile, s); err != nil {
+		mgr.fail(ctx, result.ConfigInvalid, logfields, err, "saving state")
+	}
+	logrus.WithFields(logfields).Debug("state recorded")
+}
+
+// restoreRegistry restores the registry table in containerd's config. If the
+// config changed, the previous content of the config file is returned.
+func (mgr *Manager) restoreRegistry(registry string) ([]byte, bool, error) {
+	backup, err := os.ReadFile(mgr.cfg.ConfigFile)
+	if err != nil {
+		return nil, false, fmt.Errorf("reading config: %s", err)
+	}
+
+	cfg, err := containerd.LoadConfig(mgr.cfg.ConfigFile)
+	if err != nil {
+		return nil, false, fmt.Errorf("loading config: %s", err)
+	}
+
+	current, err := containerd.GetRegistry(cfg)
+	if err != nil {
+		return nil, false, fmt.Errorf("getting registry table from config: %s", err)
+	}
+
+	if current == registry {
+		return nil, false, nil
+	}
+
+	if err := containerd.RestoreRegistry(cfg, registry); err != nil {
+		return nil, false, fmt.Errorf("restoring registry table in config: %s", err)
+	}
+
+	if err := containerd.WriteConfig(cfg, mgr.cfg.ConfigFile); err != nil {
+		return nil, true, fmt.Errorf("writting config to file: %s", err)
+	}
+
+	return backup, true, nil
+}
+
+// Uninstall reverts the changes recorded in the state file, restarting
+// containerd if its config changed, and removes the state file.
+func (mgr *Manager) Uninstall(ctx context.Context) error {
+	logfields := logrus.Fields{"state.file": mgr.cfg.StateFile}
+	s, err := loadState(mgr.cfg.StateFile)
+	if err != nil {
+		mgr.fail(ctx, result.ConfigInvalid, logfields, err, "loading state")
+	}
+
+	if s == nil {
+		logrus.WithFields(logfields).Info("no state recorded, nothing to revert")
+		return ctx.Err()
+	}
+
+	logfields = logrus.Fields{"config.file": mgr.cfg.ConfigFile}
+	var (
+		backup  []byte
+		changed bool
+	)
+	if s.RegistryUnknown {
+		logrus.WithFields(logfields).Warn("original registry table unknown, keeping registry table in config")
+	} else {
+		logrus.WithFields(logfields).Debug("restoring registry table in config")
+		backup, changed, err = mgr.restoreRegistry(s.Registry)
+		if err != nil {
+			mgr.fail(ctx, result.ConfigInvalid, logfields, err, "restoring registry table in config")
+		}
+	}
+
+	if changed {
+		logrus.WithFields(logfields).Info("registry table restored in config")
+		if !mgr.restartOrRollback(ctx, backup) {
+			return ctx.Err()
+		}
+	}
+
+	// registry hosts are removed after containerd stopped using them.
+	logfields = logrus.Fields{"registry.path": mgr.cfg.RegistryPath, "registry.hosts": s.Files}
+	if err := containerd.RemoveRegistryHosts(mgr.cfg.RegistryPath, s.Files); err != nil {
+		mgr.fail(ctx, result.ConfigInvalid, logfields, err, "removing registry hosts from path")
+	}
+	logrus.WithFields(logfields).Info("registry hosts removed from path")
+
+	if err := os.Remove(mgr.cfg.StateFile); err != nil && !os.IsNotExist(err) {
+		logrus.WithField("state.file", mgr.cfg.StateFile).WithError(err).Warn("removing state file")
+	}
+
+	mgr.recorder.Eventf(ctx, corev1.EventTypeNormal, reasonConfigReverted, "Reverted containerd registry config")
+	return ctx.Err()
+}
+
+// acquireRestartSlot blocks until a cluster-wide restart slot is acquired. It
+// returns nil if restart slots are disabled.
+func (mgr *Manager) acquireRestartSlot(ctx context.Context) *slots.Slot {
+	if mgr.cfg.RestartSlots <= 0 {
+		return nil
+	}
+
+	logfields := logrus.Fields{"slots": mgr.cfg.RestartSlots, "namespace": mgr.cfg.Namespace}
+	logrus.WithFields(logfields).Info("acquiring restart slot")
+	slot, err := slots.New(mgr.client, mgr.cfg.Namespace, mgr.cfg.NodeName, mgr.cfg.RestartSlots, mgr.cfg.RestartSlotDuration).Acquire(ctx)
+	if err != nil {
+		logrus.WithFields(logfields).WithError(err).Fatal("acquiring restart slot")
+	}
+	logrus.WithFields(logfields).WithField("lease", slot.Name()).Info("restart slot acquired")
+
+	return slot
+}
+
+func (mgr *Manager) releaseRestartSlot(ctx context.Context, slot *slots.Slot) {
+	if slot == nil {
+		return
+	}
+
+	logfields := logrus.Fields{"namespace": mgr.cfg.Namespace, "lease": slot.Name()}
+	if err := slot.Release(ctx); err != nil {
+		logrus.WithFields(logfields).WithError(err).Warn("releasing restart slot, waiting for it to expire")
+		return
+	}
+	logrus.WithFields(logfields).Info("restart slot released")
 }
 
 func (mgr *Manager) Run(ctx context.Context) error {
-	mgr.copyRegistryHosts()
+	mgr.recordState(ctx)
+	mgr.copyRegistryHosts(ctx)
 	mgr.updateRegistryPathAndRestart(ctx)
 
 	return ctx.Err()
@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apitypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	eventComponent = "containerd-registrar-agent"
+
+	reasonConfigChanged       = "ConfigChanged"
+	reasonContainerdRestarted = "ContainerdRestarted"
+	reasonConfigReverted      = "ConfigReverted"
+)
+
+// recorder records events on the agent's node. Unlike client-go's recorder
+// events are created synchronously, so they aren't lost when the agent exits
+// right after recording them.
+type recorder struct {
+	client   kubernetes.Interface
+	nodeName string
+}
+
+func (r *recorder) Eventf(ctx context.Context, eventtype, reason, messageFmt string, args ...interface{}) {
+	if r.nodeName == "" {
+		return
+	}
+
+	now := metav1.NewTime(time.Now())
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%v.%x", r.nodeName, now.UnixNano()),
+			Namespace: metav1.NamespaceDefault,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			Kind: "Node",
+			Name: r.nodeName,
+			UID:  apitypes.UID(r.nodeName),
+		},
+		Reason:              reason,
+		Message:             fmt.Sprintf(messageFmt, args...),
+		Source:              corev1.EventSource{Component: eventComponent, Host: r.nodeName},
+		FirstTimestamp:      now,
+		LastTimestamp:       now,
+		Count:               1,
+		Type:                eventtype,
+		ReportingController: eventComponent,
+		ReportingInstance:   r.nodeName,
+	}
+
+	_, err := r.client.CoreV1().Events(event.Namespace).Create(ctx, event, metav1.CreateOptions{})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"node": r.nodeName, "reason": reason}).WithError(err).Warn("recording event")
+	}
+}
@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// state records what's needed for reverting the agent's changes to a node.
+type state struct {
+	// Registry is the cri plugin's registry table, before the agent changed
+	// containerd's config for the first time. Empty if it wasn't set.
+	Registry string `json:"registry"`
+	// RegistryUnknown is set, if containerd's config already used the
+	// registry path when the state was recorded first, e.g. on nodes
+	// configured by an agent predating the state file. The registry table
+	// isn't restored then.
+	RegistryUnknown bool `json:"registryUnknown,omitempty"`
+	// Files are the names of the files installed into the registry path.
+	Files []string `json:"files"`
+}
+
+func (s *state) hasFile(name string) bool {
+	for _, file := range s.Files {
+		if file == name {
+			return true
+		}
+	}
+	return false
+}
+
+// loadState reads the state from the file. It returns nil if the file
+// doesn't exist.
+func loadState(path string) (*state, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var s state
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// saveState atomically writes the state into the file.
+func saveState(path string, s *state) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -47,6 +47,49 @@ func SetRegistryPath(cfg *toml.Tree, path string) (bool, error) {
 	return true, nil
 }
 
+// GetRegistryPath returns the cri plugin's registry config path or an empty
+// string if it isn't set.
+func GetRegistryPath(cfg *toml.Tree) string {
+	path, _ := cfg.GetPath([]string{"plugins", criPluginURI, "registry", "config_path"}).(string)
+	return path
+}
+
+// GetRegistry returns the cri plugin's registry table encoded as TOML or an
+// empty string if the table isn't set.
+func GetRegistry(cfg *toml.Tree) (string, error) {
+	val := cfg.GetPath([]string{"plugins", criPluginURI, "registry"})
+	if val == nil {
+		return "", nil
+	}
+
+	registry, ok := val.(*toml.Tree)
+	if !ok {
+		return "", errors.New("cri registry config isn't a table")
+	}
+
+	return registry.ToTomlString()
+}
+
+// RestoreRegistry sets the cri plugin's registry table to the given TOML
+// encoded table. An empty table removes the registry table from the config.
+func RestoreRegistry(cfg *toml.Tree, registry string) error {
+	path := []string{"plugins", criPluginURI, "registry"}
+	if registry == "" {
+		if !cfg.HasPath(path) {
+			return nil
+		}
+		return cfg.DeletePath(path)
+	}
+
+	tree, err := toml.Load(registry)
+	if err != nil {
+		return fmt.Errorf("parsing registry table: %s", err)
+	}
+
+	cfg.SetPath(path, tree)
+	return nil
+}
+
 func WriteConfig(cfg *toml.Tree, path string) error {
 	file, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
@@ -157,3 +200,16 @@ func CopyRegistryHosts(path string, files []string) error {
 
 	return nil
 }
+
+// RemoveRegistryHosts removes the named files from the registry path. Files
+// which don't exist are ignored.
+func RemoveRegistryHosts(path string, names []string) error {
+	for _, name := range names {
+		err := os.Remove(filepath.Join(path, filepath.Base(name)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,49 @@
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	AutoscalerCompatNone              = ""
+	AutoscalerCompatClusterAutoscaler = "cluster-autoscaler"
+	AutoscalerCompatKarpenter         = "karpenter"
+
+	clusterAutoscalerStartupTaintPrefix = "startup-taint.cluster-autoscaler.kubernetes.io/"
+	clusterAutoscalerIgnoreTaintPrefix  = "ignore-taint.cluster-autoscaler.kubernetes.io/"
+
+	karpenterTaintPrefix = "karpenter.sh/"
+)
+
+// EffectiveAgentNodeTaint validates the agent taint key for the autoscaler
+// and returns the key to be used. The cluster-autoscaler only treats taints
+// prefixed with startup-taint or ignore-taint as temporary, so other keys are
+// rewritten to a startup-taint. Karpenter's startupTaints are matched by key,
+// which therefore must not be one of Karpenter's own taints.
+func EffectiveAgentNodeTaint(key, compat string) (string, error) {
+	if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+		return "", fmt.Errorf("invalid agent taint key %q: %s", key, strings.Join(errs, ", "))
+	}
+
+	switch compat {
+	case AutoscalerCompatNone:
+		return key, nil
+	case AutoscalerCompatClusterAutoscaler:
+		if strings.HasPrefix(key, clusterAutoscalerStartupTaintPrefix) || strings.HasPrefix(key, clusterAutoscalerIgnoreTaintPrefix) {
+			return key, nil
+		}
+
+		name := key[strings.LastIndex(key, "/")+1:]
+		return clusterAutoscalerStartupTaintPrefix + name, nil
+	case AutoscalerCompatKarpenter:
+		if strings.HasPrefix(key, karpenterTaintPrefix) {
+			return "", fmt.Errorf("agent taint key %q uses karpenter's reserved prefix %s", key, karpenterTaintPrefix)
+		}
+		return key, nil
+	default:
+		return "", fmt.Errorf("unknown autoscaler compatibility %q", compat)
+	}
+}
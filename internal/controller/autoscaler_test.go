@@ -0,0 +1,78 @@
+package controller
+
+import "testing"
+
+func TestEffectiveAgentNodeTaint(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		compat  string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "no autoscaler",
+			key:  "node.containerd-registrar.io/agent-not-ready",
+			want: "node.containerd-registrar.io/agent-not-ready",
+		},
+		{
+			name:   "cluster-autoscaler rewrites key",
+			key:    "node.containerd-registrar.io/agent-not-ready",
+			compat: AutoscalerCompatClusterAutoscaler,
+			want:   "startup-taint.cluster-autoscaler.kubernetes.io/agent-not-ready",
+		},
+		{
+			name:   "cluster-autoscaler rewrites key without prefix",
+			key:    "agent-not-ready",
+			compat: AutoscalerCompatClusterAutoscaler,
+			want:   "startup-taint.cluster-autoscaler.kubernetes.io/agent-not-ready",
+		},
+		{
+			name:   "cluster-autoscaler keeps startup-taint",
+			key:    "startup-taint.cluster-autoscaler.kubernetes.io/registrar",
+			compat: AutoscalerCompatClusterAutoscaler,
+			want:   "startup-taint.cluster-autoscaler.kubernetes.io/registrar",
+		},
+		{
+			name:   "cluster-autoscaler keeps ignore-taint",
+			key:    "ignore-taint.cluster-autoscaler.kubernetes.io/registrar",
+			compat: AutoscalerCompatClusterAutoscaler,
+			want:   "ignore-taint.cluster-autoscaler.kubernetes.io/registrar",
+		},
+		{
+			name:   "karpenter keeps key",
+			key:    "node.containerd-registrar.io/agent-not-ready",
+			compat: AutoscalerCompatKarpenter,
+			want:   "node.containerd-registrar.io/agent-not-ready",
+		},
+		{
+			name:    "karpenter rejects reserved prefix",
+			key:     "karpenter.sh/agent-not-ready",
+			compat:  AutoscalerCompatKarpenter,
+			wantErr: true,
+		},
+		{
+			name:    "unknown autoscaler",
+			key:     "node.containerd-registrar.io/agent-not-ready",
+			compat:  "keda",
+			wantErr: true,
+		},
+		{
+			name:    "invalid key",
+			key:     "agent not ready",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := EffectiveAgentNodeTaint(tt.key, tt.compat)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("EffectiveAgentNodeTaint() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("EffectiveAgentNodeTaint() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package controller
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+var breakGlassAnnotation = "containerd-registrar.io/break-glass"
+
+const (
+	reasonBreakGlass         = "BreakGlass"
+	reasonBreakGlassReleased = "BreakGlassReleased"
+)
+
+// isBreakGlass reports whether the break-glass switch is set, either by flag
+// or by the break-glass ConfigMap.
+func (mgr *Manager) isBreakGlass() bool {
+	return mgr.cfg.BreakGlass || atomic.LoadInt32(&mgr.breakGlass) == 1
+}
+
+// releaseGatedNode removes the agent taint from the node and marks it as
+// degraded, as containerd might not be configured. It returns the node as
+// released.
+func (mgr *Manager) releaseGatedNode(ctx context.Context, node *corev1.Node) *corev1.Node {
+	if !hasTaintWithKey(node, mgr.cfg.AgentNodeTaint) {
+		return node
+	}
+
+	logfields := logrus.Fields{"node": node.Name}
+	logrus.WithFields(logfields).Warn("break-glass is set, releasing node")
+	updated, err := mgr.markNodeAsDegraded(ctx, node, reasonBreakGlass)
+	if err != nil {
+		logrus.WithFields(logfields).WithError(err).Warn("failed releasing node on break-glass")
+		return node
+	}
+
+	mgr.recorder.Event(node, corev1.EventTypeWarning, reasonBreakGlassReleased, "Removed agent taint, as break-glass is set")
+	return updated
+}
+
+// enqueueNodes adds all nodes to the work queue, so the workers release or
+// gate them according to the break-glass switch.
+func (mgr *Manager) enqueueNodes() {
+	for _, node := range mgr.listNodes() {
+		mgr.queue.Add(node.Name)
+	}
+}
+
+func (mgr *Manager) setBreakGlass(cm *corev1.ConfigMap) {
+	active := cm != nil && cm.Annotations[breakGlassAnnotation] == "true"
+
+	var value int32
+	if active {
+		value = 1
+	}
+
+	if atomic.SwapInt32(&mgr.breakGlass, value) == value {
+		return
+	}
+
+	logfields := logrus.Fields{"configmap": mgr.cfg.AgentPodNamespace + "/" + mgr.cfg.BreakGlassConfigMap}
+	if !active {
+		breakGlassActive.Set(0)
+		logrus.WithFields(logfields).Info("break-glass unset, gating nodes again")
+		mgr.enqueueNodes()
+		return
+	}
+
+	breakGlassActive.Set(1)
+	logrus.WithFields(logfields).Warn("break-glass set, releasing all gated nodes")
+	mgr.recorder.Event(cm, corev1.EventTypeWarning, reasonBreakGlass, "Break-glass set, releasing all gated nodes and stopping tainting")
+	mgr.enqueueNodes()
+}
+
+// watchBreakGlass watches the break-glass ConfigMap for its annotation. It's
+// called once the caches are synced and before the workers are started, so
+// the workers never gate nodes while break-glass is set. Gated nodes are
+// released by the workers through the work queue.
+func (mgr *Manager) watchBreakGlass() {
+	if mgr.cfg.BreakGlass {
+		breakGlassActive.Set(1)
+		logrus.Warn("break-glass flag set, releasing all gated nodes")
+		return
+	}
+
+	if mgr.cfg.BreakGlassConfigMap == "" {
+		return
+	}
+
+	key := mgr.cfg.AgentPodNamespace + "/" + mgr.cfg.BreakGlassConfigMap
+	if obj, exists := getObjectFromStoreByKey(mgr.configMapInformer.GetStore(), key); exists {
+		mgr.setBreakGlass(obj.(*corev1.ConfigMap))
+	}
+
+	update := func(obj interface{}) {
+		cm, ok := obj.(*corev1.ConfigMap)
+		if !ok || cm.Name != mgr.cfg.BreakGlassConfigMap {
+			return
+		}
+		mgr.setBreakGlass(cm)
+	}
+	mgr.configMapInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: update,
+		UpdateFunc: func(_, obj interface{}) {
+			update(obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+
+			cm, ok := obj.(*corev1.ConfigMap)
+			if ok && cm.Name == mgr.cfg.BreakGlassConfigMap {
+				mgr.setBreakGlass(nil)
+			}
+		},
+	})
+}
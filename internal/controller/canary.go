@@ -0,0 +1,173 @@
+package controller
+
+import (
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+var (
+	// pullFailureReasons are the waiting reasons of containers failing to
+	// pull their image or failing to start.
+	pullFailureReasons = map[string]bool{
+		"ErrImagePull":         true,
+		"ImagePullBackOff":     true,
+		"CreateContainerError": true,
+		"RunContainerError":    true,
+	}
+
+	// pullFailureEventReasons are the reasons of kubelet events reporting
+	// image pull and container start failures.
+	pullFailureEventReasons = map[string]bool{
+		"Failed":  true,
+		"BackOff": true,
+	}
+
+	// startFailureEventMessagePrefix prefixes the messages of the kubelet's
+	// Failed events for containers failing to be created or started, e.g. with
+	// CreateContainerError or RunContainerError.
+	startFailureEventMessagePrefix = "Error: "
+)
+
+// canaryEventsFieldSelector selects the warning events of pods, which include
+// the kubelet's image pull and container start failures.
+var canaryEventsFieldSelector = "type=Warning,involvedObject.kind=Pod"
+
+// selectCanaries returns the outdated nodes matching the canary node labels
+// or, if not configured or none of them matches, the canary percentage of
+// outdated nodes. Only outdated nodes are selected, so the canary phase always
+// updates its canaries.
+func (mgr *Manager) selectCanaries(outdated []*corev1.Node) map[string]bool {
+	canaries := make(map[string]bool)
+	if mgr.cfg.CanaryNodeLabels != "" {
+		selector, err := labels.Parse(mgr.cfg.CanaryNodeLabels)
+		if err != nil {
+			return canaries
+		}
+
+		for _, node := range outdated {
+			if selector.Matches(labels.Set(node.Labels)) {
+				canaries[node.Name] = true
+			}
+		}
+
+		if len(canaries) > 0 {
+			return canaries
+		}
+		logrus.WithField("labels", mgr.cfg.CanaryNodeLabels).Warn("no outdated node matches canary node labels, selecting canary percentage")
+	}
+
+	count := (len(outdated)*mgr.cfg.CanaryPercentage + 99) / 100
+	if count > len(outdated) {
+		count = len(outdated)
+	}
+
+	for _, node := range outdated[:count] {
+		canaries[node.Name] = true
+	}
+	return canaries
+}
+
+func countPodPullFailures(pod *corev1.Pod) int {
+	var failures int
+	for _, statuses := range [][]corev1.ContainerStatus{
+		pod.Status.InitContainerStatuses,
+		pod.Status.ContainerStatuses,
+	} {
+		for _, status := range statuses {
+			if status.State.Waiting != nil && pullFailureReasons[status.State.Waiting.Reason] {
+				failures++
+			}
+		}
+	}
+	return failures
+}
+
+// getPodStartTime returns the time the pod was started by the kubelet or, if
+// it hasn't been started yet, its creation time.
+func getPodStartTime(pod *corev1.Pod) time.Time {
+	if pod.Status.StartTime != nil {
+		return pod.Status.StartTime.Time
+	}
+	return pod.CreationTimestamp.Time
+}
+
+// isPullFailureEvent reports whether the event reports an image pull or
+// container start failure since the given time.
+func isPullFailureEvent(event *corev1.Event, since time.Time) bool {
+	if !pullFailureEventReasons[event.Reason] {
+		return false
+	}
+
+	if event.LastTimestamp.Time.Before(since) && event.EventTime.Time.Before(since) {
+		return false
+	}
+
+	if event.Reason == "Failed" && strings.HasPrefix(event.Message, startFailureEventMessagePrefix) {
+		return true
+	}
+	return strings.Contains(strings.ToLower(event.Message), "pull")
+}
+
+// watchCanaryEvents starts watching the warning events of pods for the canary
+// phase. The watch is stopped once the canary phase ends, so events aren't
+// cached otherwise.
+func (mgr *Manager) watchCanaryEvents() {
+	ro := mgr.rollout
+	if ro.events != nil {
+		return
+	}
+
+	ro.events = coreinformers.NewFilteredEventInformer(mgr.client, metav1.NamespaceAll, 0, cache.Indexers{}, func(opts *metav1.ListOptions) {
+		opts.FieldSelector = canaryEventsFieldSelector
+	})
+	setTransform(ro.events, stripManagedFields)
+
+	ro.stopEvents = make(chan struct{})
+	go ro.events.Run(ro.stopEvents)
+}
+
+// stopCanaryEvents stops the watch of the canary phase's events.
+func (ro *rollout) stopCanaryEvents() {
+	if ro.stopEvents != nil {
+		close(ro.stopEvents)
+	}
+	ro.events, ro.stopEvents = nil, nil
+}
+
+// countPullFailures returns the number of containers of agent pods started on
+// the given nodes since the given time, which currently fail to pull their
+// image or to start, plus the number of image pull and container start failure
+// events reported by the nodes' kubelets since then. It reports false until the canary events are
+// synced.
+func (mgr *Manager) countPullFailures(nodes map[string]bool, since time.Time) (int, bool) {
+	ro := mgr.rollout
+	if ro.events == nil || !ro.events.HasSynced() {
+		return 0, false
+	}
+
+	var failures int
+	for name := range nodes {
+		for _, pod := range mgr.getAgentPods(name) {
+			if getPodStartTime(pod).Before(since) {
+				continue
+			}
+			failures += countPodPullFailures(pod)
+		}
+	}
+
+	for _, obj := range ro.events.GetStore().List() {
+		event := obj.(*corev1.Event)
+		if nodes[event.Source.Host] && isPullFailureEvent(event, since) {
+			failures++
+		}
+	}
+
+	return failures, true
+}
@@ -0,0 +1,74 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestIsPullFailureEvent(t *testing.T) {
+	since := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		reason  string
+		message string
+		last    time.Time
+		want    bool
+	}{
+		{
+			name:    "pull failure",
+			reason:  "Failed",
+			message: `Failed to pull image "registry.example.com/app:v1": not found`,
+			last:    since.Add(time.Minute),
+			want:    true,
+		},
+		{
+			name:    "pull back-off",
+			reason:  "BackOff",
+			message: `Back-off pulling image "registry.example.com/app:v1"`,
+			last:    since.Add(time.Minute),
+			want:    true,
+		},
+		{
+			name:    "create container error",
+			reason:  "Failed",
+			message: "Error: failed to create containerd task: failed to create shim task",
+			last:    since.Add(time.Minute),
+			want:    true,
+		},
+		{
+			name:    "crash loop",
+			reason:  "BackOff",
+			message: "Back-off restarting failed container",
+			last:    since.Add(time.Minute),
+		},
+		{
+			name:    "other reason",
+			reason:  "FailedMount",
+			message: "Error: MountVolume.SetUp failed",
+			last:    since.Add(time.Minute),
+		},
+		{
+			name:    "before since",
+			reason:  "Failed",
+			message: "Error: ErrImagePull",
+			last:    since.Add(-time.Minute),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := &corev1.Event{
+				Reason:        tt.reason,
+				Message:       tt.message,
+				LastTimestamp: metav1.NewTime(tt.last),
+			}
+			if got := isPullFailureEvent(event, since); got != tt.want {
+				t.Errorf("isPullFailureEvent() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/xinau/containerd-registrar/internal/result"
+)
+
+const nodeConditionType corev1.NodeConditionType = "ContainerdRegistryConfigured"
+
+func getNodeCondition(node *corev1.Node, conditionType corev1.NodeConditionType) *corev1.NodeCondition {
+	for i := range node.Status.Conditions {
+		if node.Status.Conditions[i].Type == conditionType {
+			return &node.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// newNodeCondition returns the ContainerdRegistryConfigured condition for the
+// node in the given state.
+func newNodeCondition(node *corev1.Node, state nodeState) corev1.NodeCondition {
+	cond := corev1.NodeCondition{
+		Type:   nodeConditionType,
+		Status: corev1.ConditionFalse,
+	}
+
+	reason := node.Annotations[nodeStateReasonAnnotation]
+	switch state {
+	case nodeStateReady:
+		cond.Status = corev1.ConditionTrue
+		cond.Reason = "Configured"
+		cond.Message = "containerd registry configuration applied by registrar agent"
+	case nodeStateNew, nodeStatePending, nodeStateInitialized:
+		cond.Reason = "Pending"
+		cond.Message = "waiting for registrar agent to configure containerd registries"
+	case nodeStateFailed:
+		cond.Reason = "Failed"
+		cond.Message = "registrar agent failed to configure containerd registries"
+	case nodeStateDegraded:
+		cond.Reason = "Degraded"
+		cond.Message = "containerd is running without registrar's registry configuration"
+	case nodeStateSkipped:
+		cond.Status = corev1.ConditionUnknown
+		cond.Reason = "Skipped"
+		cond.Message = "node is skipped by the registrar"
+	default:
+		cond.Status = corev1.ConditionUnknown
+		cond.Reason = "Unknown"
+		cond.Message = "registrar agent state is unknown"
+	}
+
+	if reason != "" && state != nodeStateReady {
+		cond.Reason = reason
+	}
+
+	if msg := node.Annotations[result.MessageAnnotation]; msg != "" && state == nodeStateFailed {
+		cond.Message = fmt.Sprintf("%s: %s", cond.Message, msg)
+	}
+
+	return cond
+}
+
+// syncNodeCondition updates the node's ContainerdRegistryConfigured condition
+// through the status subresource, if it differs from the given state.
+func (mgr *Manager) syncNodeCondition(ctx context.Context, node *corev1.Node, state nodeState) {
+	cond := newNodeCondition(node, state)
+
+	now := metav1.Now()
+	cond.LastHeartbeatTime = now
+	cond.LastTransitionTime = now
+	if current := getNodeCondition(node, nodeConditionType); current != nil {
+		if current.Status == cond.Status && current.Reason == cond.Reason && current.Message == cond.Message {
+			return
+		}
+
+		if current.Status == cond.Status {
+			cond.LastTransitionTime = current.LastTransitionTime
+		}
+	}
+
+	logfields := logrus.Fields{"node": node.Name, "status": cond.Status, "reason": cond.Reason}
+	logrus.WithFields(logfields).Debug("updating node condition")
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []corev1.NodeCondition{cond},
+		},
+	})
+	if err != nil {
+		logrus.WithFields(logfields).WithError(err).Warn("failed marshalling node condition")
+		return
+	}
+
+	if _, err := mgr.client.CoreV1().Nodes().PatchStatus(ctx, node.Name, payload); err != nil {
+		logrus.WithFields(logfields).WithError(err).Warn("failed updating node condition")
+	}
+}
@@ -0,0 +1,270 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apitypes "k8s.io/apimachinery/pkg/types"
+)
+
+var configHashAnnotation = "containerd-registrar.io/config-hash"
+
+const reasonConfigHashUpdated = "ConfigHashUpdated"
+
+// getReferencedConfig returns the names of the ConfigMaps and Secrets
+// referenced by the pod spec's volumes and containers.
+func getReferencedConfig(spec *corev1.PodSpec) (configMaps, secrets []string) {
+	cms, scs := make(map[string]bool), make(map[string]bool)
+	for _, vol := range spec.Volumes {
+		if vol.ConfigMap != nil {
+			cms[vol.ConfigMap.Name] = true
+		}
+		if vol.Secret != nil {
+			scs[vol.Secret.SecretName] = true
+		}
+		if vol.Projected != nil {
+			for _, src := range vol.Projected.Sources {
+				if src.ConfigMap != nil {
+					cms[src.ConfigMap.Name] = true
+				}
+				if src.Secret != nil {
+					scs[src.Secret.Name] = true
+				}
+			}
+		}
+	}
+
+	for _, containers := range [][]corev1.Container{spec.InitContainers, spec.Containers} {
+		for _, c := range containers {
+			for _, env := range c.EnvFrom {
+				if env.ConfigMapRef != nil {
+					cms[env.ConfigMapRef.Name] = true
+				}
+				if env.SecretRef != nil {
+					scs[env.SecretRef.Name] = true
+				}
+			}
+
+			for _, env := range c.Env {
+				if env.ValueFrom == nil {
+					continue
+				}
+				if env.ValueFrom.ConfigMapKeyRef != nil {
+					cms[env.ValueFrom.ConfigMapKeyRef.Name] = true
+				}
+				if env.ValueFrom.SecretKeyRef != nil {
+					scs[env.ValueFrom.SecretKeyRef.Name] = true
+				}
+			}
+		}
+	}
+
+	for name := range cms {
+		configMaps = append(configMaps, name)
+	}
+	for name := range scs {
+		secrets = append(secrets, name)
+	}
+	sort.Strings(configMaps)
+	sort.Strings(secrets)
+
+	return configMaps, secrets
+}
+
+// writeSortedData writes the digests of the values ordered by their keys.
+func writeSortedData(w io.Writer, data map[string][]byte) {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s=%x\n", key, sha256.Sum256(data[key]))
+	}
+}
+
+// getConfigHash returns a hash of the contents of the ConfigMaps and Secrets
+// referenced by the pod spec. Missing objects are part of the hash, so their
+// creation changes it. Secrets aren't cached, but fetched by name, so the
+// controller only needs access to the referenced Secrets.
+func (mgr *Manager) getConfigHash(ctx context.Context, spec *corev1.PodSpec) (string, error) {
+	configMaps, secrets := getReferencedConfig(spec)
+	if len(configMaps) == 0 && len(secrets) == 0 {
+		return "", nil
+	}
+
+	h := sha256.New()
+	for _, name := range configMaps {
+		fmt.Fprintf(h, "configmap/%s\n", name)
+		obj, exists := getObjectFromStoreByKey(mgr.configMapInformer.GetStore(), mgr.cfg.AgentPodNamespace+"/"+name)
+		if !exists {
+			continue
+		}
+
+		cm := obj.(*corev1.ConfigMap)
+		data := make(map[string][]byte, len(cm.Data)+len(cm.BinaryData))
+		for key, value := range cm.Data {
+			data[key] = []byte(value)
+		}
+		for key, value := range cm.BinaryData {
+			data[key] = value
+		}
+		writeSortedData(h, data)
+	}
+
+	for _, name := range secrets {
+		fmt.Fprintf(h, "secret/%s\n", name)
+		secret, err := mgr.client.CoreV1().Secrets(mgr.cfg.AgentPodNamespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("getting secret %s: %s", name, err)
+		}
+		writeSortedData(h, secret.Data)
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil))[:16], nil
+}
+
+// syncConfigHash stamps the hash of the agent's ConfigMaps and Secrets onto
+// the agent DaemonSet's pod template. A changed hash creates a new DaemonSet
+// revision, which is rolled out like any other revision. Hashes of revisions
+// which failed their canary phase aren't stamped again.
+func (mgr *Manager) syncConfigHash(ctx context.Context) {
+	if !mgr.hasSynced() || !mgr.configMapInformer.HasSynced() {
+		return
+	}
+
+	ds, ok := mgr.findAgentDaemonSet()
+	if !ok {
+		return
+	}
+
+	hash, err := mgr.getConfigHash(ctx, &ds.Spec.Template.Spec)
+	if err != nil {
+		logrus.WithField("daemonset", ds.Namespace+"/"+ds.Name).WithError(err).Warn("failed hashing agent config")
+		return
+	}
+
+	current := ds.Spec.Template.Annotations[configHashAnnotation]
+	if hash == "" {
+		return
+	}
+
+	if hash == current {
+		mgr.ensureConfigRevision(ctx, &ds.Spec.Template.Spec, hash)
+		mgr.pruneConfigRevisions(ctx, hash)
+		return
+	}
+
+	logfields := logrus.Fields{"daemonset": ds.Namespace + "/" + ds.Name, "hash": hash, "hash.previous": current}
+	if mgr.isFailedConfigHash(hash) {
+		logrus.WithFields(logfields).Debug("agent config failed canary, skipping config hash")
+		return
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{configHashAnnotation: hash},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return
+	}
+
+	logrus.WithFields(logfields).Info("agent config changed, updating config hash")
+	_, err = mgr.client.AppsV1().DaemonSets(ds.Namespace).Patch(ctx, ds.Name, apitypes.MergePatchType, payload, metav1.PatchOptions{})
+	if err != nil {
+		logrus.WithFields(logfields).WithError(err).Warn("failed updating config hash")
+		return
+	}
+
+	mgr.recorder.Eventf(ds, corev1.EventTypeNormal, reasonConfigHashUpdated, "Agent config changed, updated config hash to %s", hash)
+
+	if err := mgr.recordConfigRevision(ctx, &ds.Spec.Template.Spec, hash); err != nil {
+		logrus.WithFields(logfields).WithError(err).Warn("failed recording config revision")
+	}
+}
+
+// ensureConfigRevision records the config revision of the current config
+// hash, e.g. for configs stamped before the history was recorded.
+func (mgr *Manager) ensureConfigRevision(ctx context.Context, spec *corev1.PodSpec, hash string) {
+	key := mgr.cfg.AgentPodNamespace + "/" + configRevisionNamePrefix + hash
+	if _, exists := getObjectFromStoreByKey(mgr.revisionInformer.GetStore(), key); exists {
+		return
+	}
+
+	if err := mgr.recordConfigRevision(ctx, spec, hash); err != nil && !apierrors.IsAlreadyExists(err) {
+		logrus.WithField("hash", hash).WithError(err).Warn("failed recording config revision")
+	}
+}
+
+// isFailedConfigHash reports whether the config with the given hash failed
+// its canary phase, either since the controller started or as recorded on its
+// config revision. A config revision changed since the failure without being
+// failed had its result cleared by a rollback.
+func (mgr *Manager) isFailedConfigHash(hash string) bool {
+	rv, failed := mgr.rollout.failedConfigHashes[hash]
+
+	obj, exists := getObjectFromStoreByKey(mgr.revisionInformer.GetStore(), mgr.cfg.AgentPodNamespace+"/"+configRevisionNamePrefix+hash)
+	if !exists {
+		return failed
+	}
+
+	rev := obj.(*appsv1.ControllerRevision)
+	if rev.Annotations[configRevisionResultAnnotation] == ConfigRevisionResultFailed {
+		return true
+	}
+	return failed && rev.ResourceVersion == rv
+}
+
+// getRevisionConfigHash returns the config hash of the DaemonSet revision's
+// pod template.
+func getRevisionConfigHash(rev *appsv1.ControllerRevision) string {
+	var data struct {
+		Spec struct {
+			Template struct {
+				Metadata metav1.ObjectMeta `json:"metadata"`
+			} `json:"template"`
+		} `json:"spec"`
+	}
+
+	if rev == nil || json.Unmarshal(rev.Data.Raw, &data) != nil {
+		return ""
+	}
+	return data.Spec.Template.Metadata.Annotations[configHashAnnotation]
+}
+
+// recordFailedConfig remembers the config hash of the DaemonSet's pod
+// template, which failed its canary phase, and records the failure on its
+// config revision. The config isn't blamed, if it's the same as the one of the
+// revision being rolled back to.
+func (mgr *Manager) recordFailedConfig(ctx context.Context, ds *appsv1.DaemonSet, previous *appsv1.ControllerRevision) {
+	hash := ds.Spec.Template.Annotations[configHashAnnotation]
+	if hash == "" || hash == getRevisionConfigHash(previous) {
+		return
+	}
+
+	var rv string
+	if obj, exists := getObjectFromStoreByKey(mgr.revisionInformer.GetStore(), mgr.cfg.AgentPodNamespace+"/"+configRevisionNamePrefix+hash); exists {
+		rv = obj.(*appsv1.ControllerRevision).ResourceVersion
+	}
+
+	mgr.rollout.failedConfigHashes[hash] = rv
+	mgr.setConfigRevisionResult(ctx, hash, ConfigRevisionResultFailed)
+}
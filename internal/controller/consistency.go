@@ -0,0 +1,209 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const reasonAgentDaemonSetInconsistent = "AgentDaemonSetInconsistent"
+
+// daemonSetTolerations are the taints tolerated by every DaemonSet pod, as the
+// DaemonSet controller adds tolerations for them.
+var daemonSetTolerations = map[string]bool{
+	corev1.TaintNodeNotReady:           true,
+	corev1.TaintNodeUnreachable:        true,
+	corev1.TaintNodeDiskPressure:       true,
+	corev1.TaintNodeMemoryPressure:     true,
+	corev1.TaintNodePIDPressure:        true,
+	corev1.TaintNodeUnschedulable:      true,
+	corev1.TaintNodeNetworkUnavailable: true,
+}
+
+var nodeSelectorOperators = map[corev1.NodeSelectorOperator]selection.Operator{
+	corev1.NodeSelectorOpIn:           selection.In,
+	corev1.NodeSelectorOpNotIn:        selection.NotIn,
+	corev1.NodeSelectorOpExists:       selection.Exists,
+	corev1.NodeSelectorOpDoesNotExist: selection.DoesNotExist,
+	corev1.NodeSelectorOpGt:           selection.GreaterThan,
+	corev1.NodeSelectorOpLt:           selection.LessThan,
+}
+
+func matchesNodeSelectorRequirements(reqs []corev1.NodeSelectorRequirement, set labels.Set) bool {
+	for _, req := range reqs {
+		op, ok := nodeSelectorOperators[req.Operator]
+		if !ok {
+			return false
+		}
+
+		r, err := labels.NewRequirement(req.Key, op, req.Values)
+		if err != nil || !r.Matches(set) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesNodeSelectorTerms reports whether the node matches any of the terms,
+// the same way the scheduler evaluates required node affinity.
+func matchesNodeSelectorTerms(node *corev1.Node, terms []corev1.NodeSelectorTerm) bool {
+	for _, term := range terms {
+		if len(term.MatchExpressions) == 0 && len(term.MatchFields) == 0 {
+			continue
+		}
+
+		if matchesNodeSelectorRequirements(term.MatchExpressions, labels.Set(node.Labels)) &&
+			matchesNodeSelectorRequirements(term.MatchFields, labels.Set{"metadata.name": node.Name}) {
+			return true
+		}
+	}
+	return false
+}
+
+func toleratesTaint(tolerations []corev1.Toleration, taint *corev1.Taint) bool {
+	for i := range tolerations {
+		if tolerations[i].ToleratesTaint(taint) {
+			return true
+		}
+	}
+	return false
+}
+
+// getUnschedulableReason returns why the DaemonSet's pods wouldn't be scheduled
+// onto the node or an empty string, if they would be. The agent taint isn't
+// considered, as it's checked separately.
+func (mgr *Manager) getUnschedulableReason(spec *corev1.PodSpec, node *corev1.Node) string {
+	if !labels.SelectorFromSet(spec.NodeSelector).Matches(labels.Set(node.Labels)) {
+		return "node selector doesn't match"
+	}
+
+	if spec.Affinity != nil && spec.Affinity.NodeAffinity != nil {
+		required := spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+		if required != nil && !matchesNodeSelectorTerms(node, required.NodeSelectorTerms) {
+			return "node affinity doesn't match"
+		}
+	}
+
+	for i := range node.Spec.Taints {
+		taint := &node.Spec.Taints[i]
+		if taint.Key == mgr.cfg.AgentNodeTaint || daemonSetTolerations[taint.Key] ||
+			taint.Effect == corev1.TaintEffectPreferNoSchedule {
+			continue
+		}
+
+		if !toleratesTaint(spec.Tolerations, taint) {
+			return fmt.Sprintf("taint %s isn't tolerated", taint.Key)
+		}
+	}
+
+	return ""
+}
+
+// findAgentDaemonSet returns the DaemonSet controlling the agent pods or, if
+// no agent pods exist, the DaemonSet whose pod template matches the agent pod
+// labels.
+func (mgr *Manager) findAgentDaemonSet() (*appsv1.DaemonSet, bool) {
+	if ds, ok := mgr.getAgentDaemonSet(); ok {
+		return ds, true
+	}
+
+	selector, err := labels.Parse(mgr.cfg.AgentPodLabels)
+	if err != nil {
+		return nil, false
+	}
+
+	for _, obj := range mgr.daemonSetInformer.GetStore().List() {
+		ds := obj.(*appsv1.DaemonSet)
+		if selector.Matches(labels.Set(ds.Spec.Template.Labels)) {
+			return ds, true
+		}
+	}
+
+	return nil, false
+}
+
+// checkAgentDaemonSet verifies the agent DaemonSet would schedule its pods
+// onto every node gated by the controller and tolerates the agent taint.
+// Inconsistencies are logged and recorded as event whenever they change.
+func (mgr *Manager) checkAgentDaemonSet(ctx context.Context) {
+	if !mgr.hasSynced() {
+		return
+	}
+
+	ds, ok := mgr.findAgentDaemonSet()
+	if !ok {
+		if mgr.inconsistency != "agent daemonset not found" {
+			logrus.WithField("labels", mgr.cfg.AgentPodLabels).Warn("agent daemonset matching agent pod labels not found")
+			mgr.inconsistency = "agent daemonset not found"
+		}
+		agentDaemonSetConsistent.Set(0)
+		return
+	}
+
+	spec := &ds.Spec.Template.Spec
+	taint := mgr.getAgentTaint()
+	tolerated := toleratesTaint(spec.Tolerations, &taint)
+
+	reasons := make(map[string][]string)
+	var unschedulable int
+	for _, node := range mgr.listNodes() {
+		if isSkipped(node) {
+			continue
+		}
+
+		if reason := mgr.getUnschedulableReason(spec, node); reason != "" {
+			reasons[reason] = append(reasons[reason], node.Name)
+			unschedulable++
+		}
+	}
+
+	agentDaemonSetUnschedulableNodes.Set(float64(unschedulable))
+	if tolerated && unschedulable == 0 {
+		agentDaemonSetConsistent.Set(1)
+		if mgr.inconsistency != "" {
+			logrus.WithField("daemonset", ds.Namespace+"/"+ds.Name).Info("agent daemonset is consistent with controller config")
+			mgr.inconsistency = ""
+		}
+		return
+	}
+	agentDaemonSetConsistent.Set(0)
+
+	var problems []string
+	if !tolerated {
+		problems = append(problems, fmt.Sprintf("agent taint %s isn't tolerated", taint.Key))
+	}
+
+	for reason, names := range reasons {
+		problems = append(problems, fmt.Sprintf("%s on %d nodes, e.g. %s", reason, len(names), names[0]))
+	}
+	sort.Strings(problems)
+
+	message := strings.Join(problems, "; ")
+	if message == mgr.inconsistency {
+		return
+	}
+	mgr.inconsistency = message
+
+	logrus.WithFields(logrus.Fields{
+		"daemonset":           ds.Namespace + "/" + ds.Name,
+		"taint.tolerated":     tolerated,
+		"nodes.unschedulable": unschedulable,
+		"problems":            message,
+	}).Warn("agent daemonset is inconsistent with controller config, nodes might stay pending")
+	mgr.recorder.Eventf(ds, corev1.EventTypeWarning, reasonAgentDaemonSetInconsistent,
+		"Agent DaemonSet is inconsistent with controller config: %s", message)
+}
+
+// watchAgentDaemonSetConsistency periodically checks the agent DaemonSet
+// against the controller's config.
+func (mgr *Manager) watchAgentDaemonSetConsistency(ctx context.Context) {
+	wait.UntilWithContext(ctx, mgr.checkAgentDaemonSet, rolloutSyncPeriod)
+}
@@ -7,22 +7,41 @@ import (
 	"strings"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	apitypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/metadata/metadatainformer"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/xinau/containerd-registrar/internal/result"
 )
 
 var (
-	nodeStateAnnotation = "node.containerd-registrar.io/node-state"
+	nodeStateAnnotation          = "node.containerd-registrar.io/node-state"
+	nodeStateReasonAnnotation    = "node.containerd-registrar.io/node-state-reason"
+	nodeStateTimestampAnnotation = "node.containerd-registrar.io/node-state-timestamp"
+	managedByAnnotation          = "node.containerd-registrar.io/managed-by"
+	bootIDAnnotation             = "node.containerd-registrar.io/boot-id"
+
+	managedByValue = "containerd-registrar-controller"
 
 	nodeNameIndexer = "node-name-indexer"
 )
 
+const reasonNodeRebooted = "NodeRebooted"
+
 func getObjectFromStoreByKey(store cache.Store, key string) (interface{}, bool) {
 	obj, exists, err := store.GetByKey(key)
 	if err != nil && !apierrors.IsNotFound(err) {
@@ -36,6 +55,13 @@ func getObjectFromStoreByKey(store cache.Store, key string) (interface{}, bool)
 	return obj, true
 }
 
+// isRebooted reports whether the node booted since it has been marked as ready,
+// e.g. resetting containerd's config on immutable OS images.
+func isRebooted(node *corev1.Node) bool {
+	bootID, ok := node.Annotations[bootIDAnnotation]
+	return ok && node.Status.NodeInfo.BootID != "" && bootID != node.Status.NodeInfo.BootID
+}
+
 func hasTaintWithKey(node *corev1.Node, key string) bool {
 	for _, taint := range node.Spec.Taints {
 		if taint.Key == key {
@@ -53,10 +79,10 @@ func indexByNodeName(obj interface{}) ([]string, error) {
 	return []string{pod.Spec.NodeName}, nil
 }
 
-func withLabelSelector(ls string) informers.SharedInformerOption {
-	return informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+func withLabelSelector(ls string) func(*metav1.ListOptions) {
+	return func(opts *metav1.ListOptions) {
 		opts.LabelSelector = ls
-	})
+	}
 }
 
 type Config struct {
@@ -65,41 +91,160 @@ type Config struct {
 	AgentPodNamespace string
 	AgentPodLabels    string
 	ResyncInterval    time.Duration
+	Workers           int
+
+	// AgentNodeTaintValue and AgentNodeTaintEffect default to "true" and
+	// NoSchedule.
+	AgentNodeTaintValue  string
+	AgentNodeTaintEffect corev1.TaintEffect
+
+	RolloutMaxUnavailable        intstr.IntOrString
+	RolloutMaxUnavailablePerZone int
+	RolloutReadyTimeout          time.Duration
+
+	CanaryNodeLabels      string
+	CanaryPercentage      int
+	CanaryBakeTime        time.Duration
+	CanaryMaxPullFailures int
+
+	// ConfigRevisionHistoryLimit is the number of registry config revisions
+	// kept. Zero keeps all revisions.
+	ConfigRevisionHistoryLimit int
+
+	PendingTimeout       time.Duration
+	PendingTimeoutPolicy string
+
+	NodeStateLabel string
+
+	// NodeStateHistoryLimit is the number of state transitions recorded on
+	// each node. Zero disables the history.
+	NodeStateHistoryLimit int
+
+	AgentDaemonSetManaged  bool
+	AgentDaemonSetName     string
+	AgentImage             string
+	AgentPauseImage        string
+	AgentServiceAccount    string
+	AgentRegistryConfigMap string
+	AgentRegistryFiles     []string
+	AgentRestartSlots      int
+
+	BreakGlass          bool
+	BreakGlassConfigMap string
+
+	// ExemptNamespaces and ExemptPriorityClasses select pods tolerating a
+	// NoExecute agent taint before it's added.
+	ExemptNamespaces      []string
+	ExemptPriorityClasses []string
 }
 
 type Manager struct {
-	client *kubernetes.Clientset
-	cfg    Config
+	client     kubernetes.Interface
+	metaclient metadata.Interface
+	cfg        Config
+
+	factory     informers.SharedInformerFactory
+	metaFactory metadatainformer.SharedInformerFactory
+
+	nodeInformer         cache.SharedIndexInformer
+	podInformer          cache.SharedIndexInformer
+	daemonSetInformer    cache.SharedIndexInformer
+	revisionInformer     cache.SharedIndexInformer
+	configMapInformer    cache.SharedIndexInformer
+	leaseInformer        cache.SharedIndexInformer
+	nodeMetadataInformer cache.SharedIndexInformer
+
+	// queue holds the names of nodes to reconcile, fed by node and agent pod
+	// events.
+	queue workqueue.RateLimitingInterface
+
+	broadcaster record.EventBroadcaster
+	recorder    record.EventRecorder
+
+	rollout *rollout
 
-	factory informers.SharedInformerFactory
+	// inconsistency is the last reported inconsistency between the agent
+	// DaemonSet and the controller's config.
+	inconsistency string
 
-	nodeInformer cache.SharedIndexInformer
-	podInformer  cache.SharedIndexInformer
+	// breakGlass is set to 1, if the break-glass ConfigMap is annotated.
+	breakGlass int32
 }
 
-func NewManager(client *kubernetes.Clientset, cfg Config) *Manager {
-	return &Manager{
-		client: client,
-		cfg:    cfg,
+// newEventRecorder returns a broadcaster and a recorder of the controller's
+// events.
+func newEventRecorder() (record.EventBroadcaster, record.EventRecorder) {
+	broadcaster := record.NewBroadcaster()
+	return broadcaster, broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{
+		Component: "containerd-registrar-controller",
+	})
+}
+
+func NewManager(client kubernetes.Interface, metaclient metadata.Interface, cfg Config) *Manager {
+	broadcaster, recorder := newEventRecorder()
+	mgr := &Manager{
+		client:      client,
+		metaclient:  metaclient,
+		cfg:         cfg,
+		factory:     informers.NewSharedInformerFactory(client, cfg.ResyncInterval),
+		metaFactory: metadatainformer.NewSharedInformerFactory(metaclient, cfg.ResyncInterval),
+		queue:       workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "nodes"),
+		broadcaster: broadcaster,
+		recorder:    recorder,
+		rollout:     newRollout(),
 	}
+	mgr.setupInformers()
+
+	return mgr
 }
 
-func (mgr *Manager) isAgentRunning(nodeName string) bool {
-	pods, err := mgr.podInformer.GetIndexer().ByIndex(nodeNameIndexer, nodeName)
+// getAgentPods returns the agent pods on a node which aren't being deleted.
+func (mgr *Manager) getAgentPods(nodeName string) []*corev1.Pod {
+	objs, err := mgr.podInformer.GetIndexer().ByIndex(nodeNameIndexer, nodeName)
 	if err != nil {
-		return false
+		return nil
 	}
 
-	for _, obj := range pods {
+	var pods []*corev1.Pod
+	for _, obj := range objs {
 		pod := obj.(*corev1.Pod)
-		for _, cond := range pod.Status.Conditions {
-			if cond.Type == corev1.PodReady && cond.Status == corev1.ConditionTrue {
-				return true
-			}
+		if pod.DeletionTimestamp != nil {
+			continue
 		}
+
+		pods = append(pods, pod)
 	}
 
-	return false
+	return pods
+}
+
+// getAgentReadySince returns the time agent pods have to become ready after
+// to count as running on the node. Pending nodes might have been gated again,
+// e.g. on reboot or on request, while the agent which ran before is still
+// reported as ready. So agents have to become ready after the node was gated.
+func getAgentReadySince(node *corev1.Node) time.Time {
+	if nodeState(node.Annotations[nodeStateAnnotation]) != nodeStatePending {
+		return time.Time{}
+	}
+	return getNodeStateTimestamp(node)
+}
+
+// isAgentRunning reports whether an agent pod of any revision, which became
+// ready since the given time, is running on the node and whether one of them
+// is of the DaemonSet's current revision.
+func (mgr *Manager) isAgentRunning(nodeName string, since time.Time) (running bool, current bool) {
+	for _, pod := range mgr.getAgentPods(nodeName) {
+		if !isPodReadySince(pod, since) {
+			continue
+		}
+
+		running = true
+		if mgr.isCurrentAgentPod(pod) {
+			current = true
+		}
+	}
+
+	return running, current
 }
 
 type nodeState string
@@ -109,30 +254,67 @@ const (
 	nodeStatePending     nodeState = "pending"
 	nodeStateInitialized nodeState = "initialized"
 	nodeStateReady       nodeState = "ready"
+	nodeStateDegraded    nodeState = "degraded"
+	nodeStateFailed      nodeState = "failed"
+	nodeStateSkipped     nodeState = "skipped"
 	nodeStateUnknown     nodeState = "unknown"
 )
 
 func (mgr *Manager) getNodeState(node *corev1.Node) nodeState {
+	if isSkipped(node) {
+		return nodeStateSkipped
+	}
+
 	state, ok := node.Annotations[nodeStateAnnotation]
 	nodeState := nodeState(state)
 
-	isAgentRunning := mgr.isAgentRunning(node.Name)
+	isAgentRunning, isCurrentAgentRunning := mgr.isAgentRunning(node.Name, getAgentReadySince(node))
 	hasAgentTaint := hasTaintWithKey(node, mgr.cfg.AgentNodeTaint)
 
-	if (!ok || nodeState == nodeStateNew) && !isAgentRunning && !hasAgentTaint {
+	// degraded nodes without a running agent stay degraded, as they've been
+	// released by the pending timeout policy.
+	if nodeState == nodeStateDegraded && !isAgentRunning && !hasAgentTaint {
+		return nodeStateDegraded
+	}
+
+	res := result.Result(node.Annotations[result.Annotation])
+	if res.IsFailed() && !isAgentRunning {
+		return nodeStateFailed
+	}
+
+	if res == result.RolledBack && isAgentRunning {
+		return nodeStateDegraded
+	}
+
+	// ready nodes which rebooted are gated again, as their agent might still
+	// be reported as running before it reapplied containerd's config.
+	if nodeState == nodeStateReady && isRebooted(node) {
+		return nodeStateNew
+	}
+
+	if (!ok || nodeState == nodeStateNew || nodeState == nodeStateSkipped) && !isAgentRunning && !hasAgentTaint {
 		return nodeStateNew
 	}
 
-	if !isAgentRunning && hasAgentTaint {
+	// gated nodes are only released by an agent of the current revision, as
+	// agents of outdated revisions haven't applied the current config.
+	if !isCurrentAgentRunning && hasAgentTaint {
 		return nodeStatePending
 	}
 
-	if isAgentRunning && hasAgentTaint {
+	if isCurrentAgentRunning && hasAgentTaint {
 		return nodeStateInitialized
 	}
 
 	if isAgentRunning && !hasAgentTaint {
-		return nodeStateReady
+		if nodeState == nodeStateReady {
+			return nodeStateReady
+		}
+
+		if !isCurrentAgentRunning {
+			return nodeStateNew
+		}
+		return nodeStateInitialized
 	}
 
 	return nodeStateUnknown
@@ -149,161 +331,458 @@ var escapePatchPath = strings.NewReplacer(
 	"/", "~1",
 ).Replace
 
-func (mgr *Manager) markNodeAsPending(ctx context.Context, node *corev1.Node) error {
-	var found bool
-	var taints []corev1.Taint
-	for _, taint := range node.Spec.Taints {
-		if taint.Key == mgr.cfg.AgentNodeTaint {
-			found = true
-			break
+func withoutTaint(taints []corev1.Taint, key string) []corev1.Taint {
+	var tmp []corev1.Taint
+	for _, taint := range taints {
+		if taint.Key != key {
+			tmp = append(tmp, taint)
 		}
+	}
+	return tmp
+}
 
-		taints = append(taints, taint)
+// nodePatch collects JSON patch operations for a node. The patch is
+// guarded by the node's resource version, so it fails if the node has
+// changed since it was read from the cache.
+type nodePatch struct {
+	node        *corev1.Node
+	annotations bool
+	labels      bool
+	patches     []patch
+
+	state        nodeState
+	reason       string
+	taint        *corev1.Taint
+	taintAdded   bool
+	taintRemoved bool
+
+	// history is the node's state history including the patch's transition,
+	// if it's recorded.
+	history []NodeStateTransition
+}
+
+func newNodePatch(node *corev1.Node) *nodePatch {
+	return &nodePatch{
+		node:        node,
+		annotations: node.Annotations != nil,
+		labels:      node.Labels != nil,
+		patches: []patch{{
+			OP:    "test",
+			Path:  "/metadata/resourceVersion",
+			Value: node.ResourceVersion,
+		}},
 	}
+}
 
-	if found {
-		logrus.WithField("node", node.Name).Debug("taint already found on node")
+func (np *nodePatch) setAnnotation(key string, value interface{}) {
+	if !np.annotations {
+		np.annotations = true
+		np.patches = append(np.patches, patch{
+			OP:    "add",
+			Path:  "/metadata/annotations",
+			Value: map[string]string{},
+		})
 	}
-	logrus.WithField("node", node.Name).Debug("adding agent taint and update node state to pending")
 
-	patches := []patch{{
-		OP:    "replace",
-		Path:  fmt.Sprintf("/metadata/annotations/%s", escapePatchPath(nodeStateAnnotation)),
-		Value: nodeStatePending,
-	}, {
-		OP:   "replace",
-		Path: "/spec/taints",
-		Value: append(taints, corev1.Taint{
-			Key:    mgr.cfg.AgentNodeTaint,
-			Value:  "true",
-			Effect: corev1.TaintEffectNoSchedule,
-		}),
-	}}
-
-	payload, err := json.Marshal(patches)
+	np.patches = append(np.patches, patch{
+		OP:    "add",
+		Path:  fmt.Sprintf("/metadata/annotations/%s", escapePatchPath(key)),
+		Value: value,
+	})
+}
+
+func (np *nodePatch) removeAnnotation(key string) {
+	if _, ok := np.node.Annotations[key]; !ok {
+		return
+	}
+
+	np.patches = append(np.patches, patch{
+		OP:   "remove",
+		Path: fmt.Sprintf("/metadata/annotations/%s", escapePatchPath(key)),
+	})
+}
+
+func (np *nodePatch) setLabel(key, value string) {
+	if !np.labels {
+		np.labels = true
+		np.patches = append(np.patches, patch{
+			OP:    "add",
+			Path:  "/metadata/labels",
+			Value: map[string]string{},
+		})
+	}
+
+	np.patches = append(np.patches, patch{
+		OP:    "add",
+		Path:  fmt.Sprintf("/metadata/labels/%s", escapePatchPath(key)),
+		Value: value,
+	})
+}
+
+func (np *nodePatch) removeLabel(key string) {
+	if _, ok := np.node.Labels[key]; !ok {
+		return
+	}
+
+	np.patches = append(np.patches, patch{
+		OP:   "remove",
+		Path: fmt.Sprintf("/metadata/labels/%s", escapePatchPath(key)),
+	})
+}
+
+// removeAgentResult removes the result reported by the agent, so a stale
+// result doesn't mark a gated node as failed.
+func (np *nodePatch) removeAgentResult() {
+	np.removeAnnotation(result.Annotation)
+	np.removeAnnotation(result.MessageAnnotation)
+}
+
+func (np *nodePatch) setTaints(taints []corev1.Taint) {
+	if taints == nil {
+		taints = []corev1.Taint{}
+	}
+
+	np.patches = append(np.patches, patch{
+		OP:    "add",
+		Path:  "/spec/taints",
+		Value: taints,
+	})
+}
+
+func (np *nodePatch) addTaint(taint corev1.Taint) {
+	np.taint = &taint
+	np.taintAdded = !hasTaintWithKey(np.node, taint.Key)
+	np.setTaints(append(withoutTaint(np.node.Spec.Taints, taint.Key), taint))
+}
+
+func (np *nodePatch) removeTaint(key string) {
+	np.taintRemoved = hasTaintWithKey(np.node, key)
+	np.setTaints(withoutTaint(np.node.Spec.Taints, key))
+}
+
+// applyNodePatch applies the patch to the node and returns the patched node.
+func (mgr *Manager) applyNodePatch(ctx context.Context, np *nodePatch) (*corev1.Node, error) {
+	payload, err := json.Marshal(np.patches)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// exempt pods have to tolerate a NoExecute taint before it's added, as
+	// they'd be evicted otherwise.
+	if needsExemptTolerations(np) {
+		if err := mgr.tolerateExemptPods(ctx, np.node.Name); err != nil {
+			return nil, fmt.Errorf("adding agent taint toleration to exempt pods: %s", err)
+		}
+	}
+
+	node, err := mgr.client.CoreV1().Nodes().Patch(ctx, np.node.Name, apitypes.JSONPatchType, payload, metav1.PatchOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	mgr.recordNodePatchEvents(np)
+	return node, nil
+}
+
+// newNodeStatePatch returns a patch updating the node's state annotations and
+// label. The state timestamp is only updated if the state changes.
+func (mgr *Manager) newNodeStatePatch(node *corev1.Node, state nodeState, reason string) *nodePatch {
+	np := newNodePatch(node)
+	np.state = state
+	np.reason = reason
+	np.setAnnotation(managedByAnnotation, managedByValue)
+	np.setAnnotation(nodeStateAnnotation, state)
+	if mgr.cfg.NodeStateLabel != "" {
+		np.setLabel(mgr.cfg.NodeStateLabel, string(state))
+	}
+
+	if reason != "" {
+		np.setAnnotation(nodeStateReasonAnnotation, reason)
+	} else {
+		np.removeAnnotation(nodeStateReasonAnnotation)
+	}
+
+	now := time.Now().UTC()
+	if nodeState(node.Annotations[nodeStateAnnotation]) != state {
+		np.setAnnotation(nodeStateTimestampAnnotation, now.Format(time.RFC3339))
+	}
+	mgr.setNodeStateHistory(np, state, reason, now.Truncate(time.Second))
+
+	return np
+}
+
+// getNodeStateTimestamp returns the time the node entered its current state.
+// It falls back to the node's creation time, e.g. for nodes registered with
+// the agent taint.
+func getNodeStateTimestamp(node *corev1.Node) time.Time {
+	ts, err := time.Parse(time.RFC3339, node.Annotations[nodeStateTimestampAnnotation])
+	if err != nil {
+		return node.CreationTimestamp.Time
+	}
+	return ts
+}
+
+func (mgr *Manager) getAgentTaint() corev1.Taint {
+	taint := corev1.Taint{
+		Key:    mgr.cfg.AgentNodeTaint,
+		Value:  mgr.cfg.AgentNodeTaintValue,
+		Effect: mgr.cfg.AgentNodeTaintEffect,
 	}
 
-	_, err = mgr.client.CoreV1().Nodes().Patch(ctx, node.Name, apitypes.JSONPatchType, payload, metav1.PatchOptions{})
-	return err
+	if taint.Value == "" {
+		taint.Value = "true"
+	}
+	if taint.Effect == "" {
+		taint.Effect = corev1.TaintEffectNoSchedule
+	}
+	return taint
 }
 
-func (mgr *Manager) markNodeAsReady(ctx context.Context, node *corev1.Node) error {
-	var found bool
-	var taints []corev1.Taint
+// getAgentTaintFor returns the agent taint to gate the node with. A taint
+// already on the node is kept. NoExecute is only used for new nodes, as it
+// would evict the workloads of nodes gated again, e.g. on rollouts or
+// reboots, which are gated with NoSchedule instead.
+func (mgr *Manager) getAgentTaintFor(node *corev1.Node) corev1.Taint {
 	for _, taint := range node.Spec.Taints {
-		if taint.Key != mgr.cfg.AgentNodeTaint {
-			found = true
-			break
+		if taint.Key == mgr.cfg.AgentNodeTaint {
+			return taint
 		}
+	}
 
-		taints = append(taints, taint)
+	taint := mgr.getAgentTaint()
+	if _, ok := node.Annotations[nodeStateAnnotation]; ok && taint.Effect == corev1.TaintEffectNoExecute {
+		taint.Effect = corev1.TaintEffectNoSchedule
 	}
+	return taint
+}
 
-	if !found {
+func (mgr *Manager) markNodeAsPending(ctx context.Context, node *corev1.Node, reason string) (*corev1.Node, error) {
+	if hasTaintWithKey(node, mgr.cfg.AgentNodeTaint) {
+		logrus.WithField("node", node.Name).Debug("taint already found on node")
+	}
+	logrus.WithField("node", node.Name).Debug("adding agent taint and update node state to pending")
+
+	np := mgr.newNodeStatePatch(node, nodeStatePending, reason)
+	np.addTaint(mgr.getAgentTaintFor(node))
+	np.removeAgentResult()
+
+	return mgr.applyNodePatch(ctx, np)
+}
+
+func (mgr *Manager) markNodeAsFailed(ctx context.Context, node *corev1.Node, reason string) (*corev1.Node, error) {
+	logrus.WithFields(logrus.Fields{"node": node.Name, "reason": reason}).Debug("keeping agent taint and update node state to failed")
+
+	np := mgr.newNodeStatePatch(node, nodeStateFailed, reason)
+	np.addTaint(mgr.getAgentTaintFor(node))
+
+	return mgr.applyNodePatch(ctx, np)
+}
+
+func (mgr *Manager) markNodeAsReady(ctx context.Context, node *corev1.Node) (*corev1.Node, error) {
+	if !hasTaintWithKey(node, mgr.cfg.AgentNodeTaint) {
 		logrus.WithField("node", node.Name).Debug("agent taint not found on node")
 	}
 	logrus.WithField("node", node.Name).Debug("removing agent taint and update node state to ready")
 
-	patches := []patch{{
-		OP:    "replace",
-		Path:  fmt.Sprintf("/metadata/annotations/%s", escapePatchPath(nodeStateAnnotation)),
-		Value: nodeStateReady,
-	}, {
-		OP:    "replace",
-		Path:  "/spec/taints",
-		Value: taints,
-	}}
+	np := mgr.newNodeStatePatch(node, nodeStateReady, "")
+	np.removeTaint(mgr.cfg.AgentNodeTaint)
+	if bootID := node.Status.NodeInfo.BootID; bootID != "" {
+		np.setAnnotation(bootIDAnnotation, bootID)
+	}
 
-	payload, err := json.Marshal(patches)
+	updated, err := mgr.applyNodePatch(ctx, np)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	_, err = mgr.client.CoreV1().Nodes().Patch(ctx, node.Name, apitypes.JSONPatchType, payload, metav1.PatchOptions{})
-	return err
+	observeTimeToReady(np)
+	return updated, nil
+}
+
+func (mgr *Manager) markNodeAsDegraded(ctx context.Context, node *corev1.Node, reason string) (*corev1.Node, error) {
+	logrus.WithFields(logrus.Fields{"node": node.Name, "reason": reason}).Debug("removing agent taint and update node state to degraded")
+
+	np := mgr.newNodeStatePatch(node, nodeStateDegraded, reason)
+	np.removeTaint(mgr.cfg.AgentNodeTaint)
+
+	return mgr.applyNodePatch(ctx, np)
 }
 
-func (mgr *Manager) checkAndMarkNode(ctx context.Context, nodeName string) {
+func (mgr *Manager) markNodeAsSkipped(ctx context.Context, node *corev1.Node) (*corev1.Node, error) {
+	logrus.WithField("node", node.Name).Debug("removing agent taint and update node state to skipped")
+
+	np := mgr.newNodeStatePatch(node, nodeStateSkipped, "")
+	np.removeTaint(mgr.cfg.AgentNodeTaint)
+
+	return mgr.applyNodePatch(ctx, np)
+}
+
+// checkAndMarkNode reconciles the node's state. Errors marking the node are
+// returned, so the node is retried. The state label and condition are synced
+// from the node as patched, so they reflect the state written.
+func (mgr *Manager) checkAndMarkNode(ctx context.Context, nodeName string) error {
 	obj, exists := getObjectFromStoreByKey(mgr.nodeInformer.GetStore(), nodeName)
 	if !exists {
-		return
+		return nil
 	}
 
 	node := obj.(*corev1.Node)
-	switch mgr.getNodeState(node) {
+	if mgr.isBreakGlass() {
+		updated := mgr.releaseGatedNode(ctx, node)
+		mgr.syncNodeCondition(ctx, updated, mgr.getNodeState(updated))
+		return nil
+	}
+
+	if _, ok := node.Annotations[reconcileRequestedAnnotation]; ok {
+		return mgr.reconcileNode(ctx, node)
+	}
+
+	current := nodeState(node.Annotations[nodeStateAnnotation])
+	hasAgentTaint := hasTaintWithKey(node, mgr.cfg.AgentNodeTaint)
+	reason := result.Result(node.Annotations[result.Annotation]).Reason()
+
+	var err error
+	state := mgr.getNodeState(node)
+	updated, written := node, state
+	switch state {
 	case nodeStateNew:
+		var pendingReason string
+		if isRebooted(node) {
+			logrus.WithFields(logrus.Fields{"node": node.Name, "boot-id": node.Status.NodeInfo.BootID}).Info("node rebooted, gating node again")
+			pendingReason = reasonNodeRebooted
+		}
+
 		logrus.WithField("node", node.Name).Debug("marking node as pending")
-		if err := mgr.markNodeAsPending(ctx, node); err != nil {
+		written = nodeStatePending
+		if updated, err = mgr.markNodeAsPending(ctx, node, pendingReason); err != nil {
 			logrus.WithField("node", nodeName).WithError(err).Warn("failed marking node as pending")
 		}
+	case nodeStatePending:
+		if mgr.isStaleAgentRunning(node) {
+			logrus.WithField("node", node.Name).Info("waiting for agent of current revision, outdated agent is running")
+		}
+
+		// agents which became ready before the node was gated don't release
+		// the node, so they're restarted to reapply containerd's config.
+		if pods := mgr.getAgentPodsReadyBefore(node.Name, getAgentReadySince(node)); len(pods) > 0 {
+			logrus.WithField("node", node.Name).Info("deleting agent pods, which became ready before node was gated")
+			if err = mgr.deleteAgentPods(ctx, pods); err != nil {
+				logrus.WithField("node", nodeName).WithError(err).Warn("failed deleting agent pods")
+			}
+		}
+		updated, written = mgr.checkPendingTimeout(ctx, node, state)
+	case nodeStateFailed:
+		if current == nodeStateFailed && hasAgentTaint && node.Annotations[nodeStateReasonAnnotation] == reason {
+			updated, written = mgr.checkPendingTimeout(ctx, node, state)
+			break
+		}
+
+		logrus.WithFields(logrus.Fields{"node": node.Name, "reason": reason}).Warn("marking node as failed")
+		if updated, err = mgr.markNodeAsFailed(ctx, node, reason); err != nil {
+			logrus.WithField("node", nodeName).WithError(err).Warn("failed marking node as failed")
+		}
+	case nodeStateDegraded:
+		if current == nodeStateDegraded && !hasAgentTaint {
+			break
+		}
+
+		logrus.WithFields(logrus.Fields{"node": node.Name, "reason": reason}).Warn("marking node as degraded")
+		if updated, err = mgr.markNodeAsDegraded(ctx, node, reason); err != nil {
+			logrus.WithField("node", nodeName).WithError(err).Warn("failed marking node as degraded")
+		}
+	case nodeStateSkipped:
+		if current == nodeStateSkipped && !hasAgentTaint {
+			break
+		}
+
+		logrus.WithField("node", node.Name).Info("marking node as skipped")
+		if updated, err = mgr.markNodeAsSkipped(ctx, node); err != nil {
+			logrus.WithField("node", nodeName).WithError(err).Warn("failed marking node as skipped")
+		}
 	case nodeStateInitialized:
 		logrus.WithField("node", node.Name).Debug("marking node as ready")
-		if err := mgr.markNodeAsReady(ctx, node); err != nil {
+		written = nodeStateReady
+		if updated, err = mgr.markNodeAsReady(ctx, node); err != nil {
 			logrus.WithField("node", nodeName).WithError(err).Warn("failed marking node as ready")
 		}
 	case nodeStateUnknown:
 		logrus.WithField("node", nodeName).Warn("node state is unknown")
 	}
 
-	return
+	if err != nil {
+		return err
+	}
+
+	mgr.syncNodeStateLabel(ctx, updated)
+	mgr.syncNodeCondition(ctx, updated, written)
+
+	return nil
 }
 
-func (mgr *Manager) processNextPodItem(ctx context.Context, key interface{}) bool {
-	obj, exists := getObjectFromStoreByKey(mgr.podInformer.GetStore(), key.(string))
-	if !exists {
-		return ctx.Err() == nil
+// processNextNode reconciles the next node from the work queue. Failed nodes
+// are requeued with backoff.
+func (mgr *Manager) processNextNode(ctx context.Context) bool {
+	key, quit := mgr.queue.Get()
+	if quit {
+		return false
 	}
+	defer mgr.queue.Done(key)
 
-	pod := obj.(*corev1.Pod)
-	mgr.checkAndMarkNode(ctx, pod.Spec.NodeName)
+	if err := mgr.checkAndMarkNode(ctx, key.(string)); err != nil {
+		mgr.queue.AddRateLimited(key)
+		return ctx.Err() == nil
+	}
 
+	mgr.queue.Forget(key)
 	return ctx.Err() == nil
 }
 
-func (mgr *Manager) processNextNodeItem(ctx context.Context, key interface{}) bool {
-	mgr.checkAndMarkNode(ctx, key.(string))
-	return ctx.Err() == nil
+func (mgr *Manager) runWorker(ctx context.Context) {
+	for mgr.processNextNode(ctx) {
+	}
 }
 
-func (mgr *Manager) watchPods(ctx context.Context) {
-	factory := informers.NewSharedInformerFactoryWithOptions(mgr.client, mgr.cfg.ResyncInterval,
-		informers.WithNamespace(mgr.cfg.AgentPodNamespace),
-		withLabelSelector(mgr.cfg.AgentPodLabels),
-	)
-	mgr.podInformer = factory.Core().V1().Pods().Informer()
+func (mgr *Manager) Run(ctx context.Context) error {
+	mgr.broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+		Interface: mgr.client.CoreV1().Events(""),
+	})
+	defer mgr.broadcaster.Shutdown()
 
-	queue := NewQueueEventHandler()
-	mgr.podInformer.AddEventHandler(queue.GetEventHandler())
-	mgr.podInformer.AddIndexers(cache.Indexers{nodeNameIndexer: indexByNodeName})
+	prometheus.MustRegister(&nodeStateCollector{mgr: mgr})
 
-	go mgr.podInformer.Run(ctx.Done())
-	cache.WaitForCacheSync(ctx.Done(), mgr.podInformer.HasSynced)
+	defer mgr.queue.ShutDown()
 
-	for queue.ProcessNextKey(ctx, mgr.processNextPodItem) {
-	}
-}
+	mgr.factory.Start(ctx.Done())
+	mgr.metaFactory.Start(ctx.Done())
 
-func (mgr *Manager) watchNodes(ctx context.Context) {
-	factory := informers.NewSharedInformerFactoryWithOptions(mgr.client, mgr.cfg.ResyncInterval,
-		withLabelSelector(mgr.cfg.AgentNodeLabels),
-	)
-	mgr.nodeInformer = factory.Core().V1().Nodes().Informer()
+	logrus.Info("waiting for informer caches to sync")
+	if err := mgr.waitForCacheSync(ctx.Done()); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
 
-	queue := NewQueueEventHandler()
-	mgr.nodeInformer.AddEventHandler(queue.GetEventHandler())
+	mgr.watchBreakGlass()
 
-	go mgr.nodeInformer.Run(ctx.Done())
-	cache.WaitForCacheSync(ctx.Done(), mgr.nodeInformer.HasSynced)
+	workers := mgr.cfg.Workers
+	if workers < 1 {
+		workers = 1
+	}
 
-	for queue.ProcessNextKey(ctx, mgr.processNextNodeItem) {
+	logrus.WithField("workers", workers).Info("informer caches synced, starting workers")
+	for i := 0; i < workers; i++ {
+		go wait.UntilWithContext(ctx, mgr.runWorker, time.Second)
 	}
-}
 
-func (mgr *Manager) Run(ctx context.Context) error {
-	go mgr.watchNodes(ctx)
-	mgr.watchPods(ctx)
+	go mgr.watchRollout(ctx)
+	go mgr.watchRestartSlots(ctx)
+	go mgr.watchReleasedNodes(ctx)
+	go mgr.watchAgentDaemonSetConsistency(ctx)
+	if mgr.cfg.AgentDaemonSetManaged {
+		go mgr.watchAgentDaemonSet(ctx)
+	}
 
+	<-ctx.Done()
 	return ctx.Err()
 }
@@ -0,0 +1,239 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/xinau/containerd-registrar/internal/result"
+)
+
+// newTestManager returns a manager whose pod informer holds the given agent
+// pods. The informers aren't started, so agent revisions are unknown and all
+// agent pods are considered current.
+func newTestManager(t *testing.T, cfg Config, pods ...*corev1.Pod) *Manager {
+	mgr := &Manager{
+		cfg: cfg,
+		podInformer: cache.NewSharedIndexInformer(&cache.ListWatch{}, &corev1.Pod{}, 0, cache.Indexers{
+			cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+			nodeNameIndexer:      indexByNodeName,
+		}),
+		daemonSetInformer: cache.NewSharedIndexInformer(&cache.ListWatch{}, &appsv1.DaemonSet{}, 0, cache.Indexers{}),
+		revisionInformer:  cache.NewSharedIndexInformer(&cache.ListWatch{}, &appsv1.ControllerRevision{}, 0, cache.Indexers{}),
+	}
+
+	for _, pod := range pods {
+		if err := mgr.podInformer.GetIndexer().Add(pod); err != nil {
+			t.Fatalf("adding pod: %s", err)
+		}
+	}
+	return mgr
+}
+
+func newAgentPod(nodeName string, readySince time.Time) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "agent-" + nodeName, Namespace: "kube-system"},
+		Spec:       corev1.PodSpec{NodeName: nodeName},
+		Status: corev1.PodStatus{Conditions: []corev1.PodCondition{{
+			Type:               corev1.PodReady,
+			Status:             corev1.ConditionTrue,
+			LastTransitionTime: metav1.NewTime(readySince),
+		}}},
+	}
+}
+
+func TestGetNodeState(t *testing.T) {
+	const key = "node.containerd-registrar.io/agent-not-ready"
+
+	now := time.Now().UTC().Truncate(time.Second)
+	gated := now.Add(-time.Minute)
+	taints := []corev1.Taint{{Key: key, Value: "true", Effect: corev1.TaintEffectNoSchedule}}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		taints      []corev1.Taint
+		bootID      string
+		agent       *corev1.Pod
+		want        nodeState
+	}{
+		{
+			name: "unmanaged node without agent",
+			want: nodeStateNew,
+		},
+		{
+			name:        "skipped node",
+			annotations: map[string]string{skipAnnotation: "true"},
+			taints:      taints,
+			want:        nodeStateSkipped,
+		},
+		{
+			name:   "registered with taint",
+			taints: taints,
+			want:   nodeStatePending,
+		},
+		{
+			name:        "pending without agent",
+			annotations: map[string]string{nodeStateAnnotation: string(nodeStatePending)},
+			taints:      taints,
+			want:        nodeStatePending,
+		},
+		{
+			name:   "agent ready on registered node",
+			taints: taints,
+			agent:  newAgentPod("node", now),
+			want:   nodeStateInitialized,
+		},
+		{
+			name: "agent ready since node was gated",
+			annotations: map[string]string{
+				nodeStateAnnotation:          string(nodeStatePending),
+				nodeStateTimestampAnnotation: gated.Format(time.RFC3339),
+			},
+			taints: taints,
+			agent:  newAgentPod("node", now),
+			want:   nodeStateInitialized,
+		},
+		{
+			name: "agent ready before node was gated",
+			annotations: map[string]string{
+				nodeStateAnnotation:          string(nodeStatePending),
+				nodeStateTimestampAnnotation: gated.Format(time.RFC3339),
+			},
+			taints: taints,
+			agent:  newAgentPod("node", gated.Add(-time.Hour)),
+			want:   nodeStatePending,
+		},
+		{
+			name:        "ready node",
+			annotations: map[string]string{nodeStateAnnotation: string(nodeStateReady), bootIDAnnotation: "a"},
+			bootID:      "a",
+			agent:       newAgentPod("node", gated),
+			want:        nodeStateReady,
+		},
+		{
+			name:        "ready node rebooted",
+			annotations: map[string]string{nodeStateAnnotation: string(nodeStateReady), bootIDAnnotation: "a"},
+			bootID:      "b",
+			agent:       newAgentPod("node", gated),
+			want:        nodeStateNew,
+		},
+		{
+			name:  "unmanaged node with agent",
+			agent: newAgentPod("node", gated),
+			want:  nodeStateInitialized,
+		},
+		{
+			name: "agent failed",
+			annotations: map[string]string{
+				nodeStateAnnotation: string(nodeStatePending),
+				result.Annotation:   string(result.ConfigInvalid),
+			},
+			taints: taints,
+			want:   nodeStateFailed,
+		},
+		{
+			name: "agent rolled back",
+			annotations: map[string]string{
+				nodeStateAnnotation: string(nodeStatePending),
+				result.Annotation:   string(result.RolledBack),
+			},
+			taints: taints,
+			agent:  newAgentPod("node", now),
+			want:   nodeStateDegraded,
+		},
+		{
+			name:        "degraded node without agent",
+			annotations: map[string]string{nodeStateAnnotation: string(nodeStateDegraded)},
+			want:        nodeStateDegraded,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pods []*corev1.Pod
+			if tt.agent != nil {
+				pods = append(pods, tt.agent)
+			}
+			mgr := newTestManager(t, Config{AgentNodeTaint: key}, pods...)
+
+			node := &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              "node",
+					Annotations:       tt.annotations,
+					CreationTimestamp: metav1.NewTime(gated.Add(-time.Hour)),
+				},
+				Spec:   corev1.NodeSpec{Taints: tt.taints},
+				Status: corev1.NodeStatus{NodeInfo: corev1.NodeSystemInfo{BootID: tt.bootID}},
+			}
+			if got := mgr.getNodeState(node); got != tt.want {
+				t.Errorf("getNodeState() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetAgentTaintFor(t *testing.T) {
+	const key = "node.containerd-registrar.io/agent-not-ready"
+
+	tests := []struct {
+		name   string
+		effect corev1.TaintEffect
+		node   *corev1.Node
+		want   corev1.Taint
+	}{
+		{
+			name: "default effect",
+			node: &corev1.Node{},
+			want: corev1.Taint{Key: key, Value: "true", Effect: corev1.TaintEffectNoSchedule},
+		},
+		{
+			name:   "new node with NoExecute",
+			effect: corev1.TaintEffectNoExecute,
+			node:   &corev1.Node{},
+			want:   corev1.Taint{Key: key, Value: "true", Effect: corev1.TaintEffectNoExecute},
+		},
+		{
+			name:   "managed node with NoExecute",
+			effect: corev1.TaintEffectNoExecute,
+			node: &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{nodeStateAnnotation: string(nodeStateReady)},
+			}},
+			want: corev1.Taint{Key: key, Value: "true", Effect: corev1.TaintEffectNoSchedule},
+		},
+		{
+			name:   "managed node with NoSchedule",
+			effect: corev1.TaintEffectNoSchedule,
+			node: &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{nodeStateAnnotation: string(nodeStateReady)},
+			}},
+			want: corev1.Taint{Key: key, Value: "true", Effect: corev1.TaintEffectNoSchedule},
+		},
+		{
+			name:   "existing taint is kept",
+			effect: corev1.TaintEffectNoSchedule,
+			node: &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{nodeStateAnnotation: string(nodeStatePending)},
+				},
+				Spec: corev1.NodeSpec{Taints: []corev1.Taint{
+					{Key: key, Value: "registered", Effect: corev1.TaintEffectNoExecute},
+				}},
+			},
+			want: corev1.Taint{Key: key, Value: "registered", Effect: corev1.TaintEffectNoExecute},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := &Manager{cfg: Config{AgentNodeTaint: key, AgentNodeTaintEffect: tt.effect}}
+			if got := mgr.getAgentTaintFor(tt.node); got != tt.want {
+				t.Errorf("getAgentTaintFor() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+var (
+	agentDaemonSetSpecHashAnnotation = "containerd-registrar.io/spec-hash"
+
+	agentRegistryFilesPath = "/etc/registrar"
+	agentContainerdPath    = "/etc/containerd"
+)
+
+// newAgentNodeAffinity returns a node affinity matching the agent node labels
+// or nil, if the agent node labels match all nodes.
+func newAgentNodeAffinity(selector string) (*corev1.Affinity, error) {
+	ls, err := metav1.ParseToLabelSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	var reqs []corev1.NodeSelectorRequirement
+	for key, value := range ls.MatchLabels {
+		reqs = append(reqs, corev1.NodeSelectorRequirement{
+			Key:      key,
+			Operator: corev1.NodeSelectorOpIn,
+			Values:   []string{value},
+		})
+	}
+
+	for _, expr := range ls.MatchExpressions {
+		reqs = append(reqs, corev1.NodeSelectorRequirement{
+			Key:      expr.Key,
+			Operator: corev1.NodeSelectorOperator(expr.Operator),
+			Values:   expr.Values,
+		})
+	}
+
+	if len(reqs) == 0 {
+		return nil, nil
+	}
+
+	// requirements are sorted, as the spec hash depends on their order.
+	sort.Slice(reqs, func(i, j int) bool {
+		return reqs[i].Key < reqs[j].Key
+	})
+
+	return &corev1.Affinity{
+		NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+				NodeSelectorTerms: []corev1.NodeSelectorTerm{{MatchExpressions: reqs}},
+			},
+		},
+	}, nil
+}
+
+// newAgentDaemonSet returns the agent DaemonSet derived from the controller's
+// config. Its pods match the agent pod labels, are scheduled onto nodes
+// matching the agent node labels and tolerate the agent taint.
+func (mgr *Manager) newAgentDaemonSet() (*appsv1.DaemonSet, error) {
+	podLabels, err := labels.ConvertSelectorToLabelsMap(mgr.cfg.AgentPodLabels)
+	if err != nil {
+		return nil, fmt.Errorf("agent pod labels must only contain equality requirements: %s", err)
+	}
+
+	affinity, err := newAgentNodeAffinity(mgr.cfg.AgentNodeLabels)
+	if err != nil {
+		return nil, fmt.Errorf("parsing agent node labels: %s", err)
+	}
+
+	var (
+		items []corev1.KeyToPath
+		files []string
+	)
+	for _, file := range mgr.cfg.AgentRegistryFiles {
+		items = append(items, corev1.KeyToPath{Key: file, Path: file})
+		files = append(files, path.Join(agentRegistryFilesPath, file))
+	}
+
+	privileged := true
+	template := corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: podLabels,
+		},
+		Spec: corev1.PodSpec{
+			Affinity: affinity,
+			InitContainers: []corev1.Container{{
+				Name:            "agent",
+				Image:           mgr.cfg.AgentImage,
+				ImagePullPolicy: corev1.PullIfNotPresent,
+				Args: []string{
+					"agent",
+					"--containerd-binary=/usr/bin/containerd",
+					"--containerd-config-file=" + path.Join(agentContainerdPath, "config.toml"),
+					"--containerd-cri-registry-path=" + path.Join(agentContainerdPath, "certs.d"),
+					"--containerd-cri-registry-files=" + strings.Join(files, ","),
+					"--restart.slots=" + strconv.Itoa(mgr.cfg.AgentRestartSlots),
+				},
+				Env: []corev1.EnvVar{{
+					Name: "NODE_NAME",
+					ValueFrom: &corev1.EnvVarSource{
+						FieldRef: &corev1.ObjectFieldSelector{FieldPath: "spec.nodeName"},
+					},
+				}, {
+					Name: "POD_NAMESPACE",
+					ValueFrom: &corev1.EnvVarSource{
+						FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"},
+					},
+				}},
+				SecurityContext: &corev1.SecurityContext{Privileged: &privileged},
+				VolumeMounts: []corev1.VolumeMount{{
+					Name:      "etc-containerd",
+					MountPath: agentContainerdPath,
+				}, {
+					Name:      "etc-registrar",
+					MountPath: agentRegistryFilesPath,
+					ReadOnly:  true,
+				}},
+			}},
+			Containers: []corev1.Container{{
+				Name:  "pause",
+				Image: mgr.cfg.AgentPauseImage,
+			}},
+			HostPID:            true,
+			ServiceAccountName: mgr.cfg.AgentServiceAccount,
+			Volumes: []corev1.Volume{{
+				Name: "etc-containerd",
+				VolumeSource: corev1.VolumeSource{
+					HostPath: &corev1.HostPathVolumeSource{Path: agentContainerdPath},
+				},
+			}, {
+				Name: "etc-registrar",
+				VolumeSource: corev1.VolumeSource{
+					ConfigMap: &corev1.ConfigMapVolumeSource{
+						LocalObjectReference: corev1.LocalObjectReference{Name: mgr.cfg.AgentRegistryConfigMap},
+						Items:                items,
+					},
+				},
+			}},
+			// the agent taint is tolerated regardless of its effect.
+			Tolerations: []corev1.Toleration{{
+				Key:      mgr.cfg.AgentNodeTaint,
+				Operator: corev1.TolerationOpExists,
+			}},
+		},
+	}
+
+	return &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      mgr.cfg.AgentDaemonSetName,
+			Namespace: mgr.cfg.AgentPodNamespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/component":  "agent",
+				"app.kubernetes.io/part-of":    "containerd-registrar",
+				"app.kubernetes.io/managed-by": managedByValue,
+			},
+		},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: podLabels},
+			Template: template,
+			UpdateStrategy: appsv1.DaemonSetUpdateStrategy{
+				Type: appsv1.OnDeleteDaemonSetStrategyType,
+			},
+		},
+	}, nil
+}
+
+func hashDaemonSetSpec(spec *appsv1.DaemonSetSpec) (string, error) {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data))[:16], nil
+}
+
+// syncAgentDaemonSet creates the agent DaemonSet or updates it, if its spec
+// differs from the one derived from the controller's config. Specs are
+// compared by the hash recorded on the DaemonSet, as the API server defaults
+// fields of the stored spec.
+func (mgr *Manager) syncAgentDaemonSet(ctx context.Context) {
+	if !mgr.daemonSetInformer.HasSynced() {
+		return
+	}
+
+	logfields := logrus.Fields{"daemonset": mgr.cfg.AgentPodNamespace + "/" + mgr.cfg.AgentDaemonSetName}
+	desired, err := mgr.newAgentDaemonSet()
+	if err != nil {
+		logrus.WithFields(logfields).WithError(err).Error("building agent daemonset")
+		return
+	}
+
+	hash, err := hashDaemonSetSpec(&desired.Spec)
+	if err != nil {
+		logrus.WithFields(logfields).WithError(err).Error("hashing agent daemonset spec")
+		return
+	}
+	desired.Annotations = map[string]string{agentDaemonSetSpecHashAnnotation: hash}
+
+	obj, exists := getObjectFromStoreByKey(mgr.daemonSetInformer.GetStore(), desired.Namespace+"/"+desired.Name)
+	if !exists {
+		logrus.WithFields(logfields).Info("creating agent daemonset")
+		_, err := mgr.client.AppsV1().DaemonSets(desired.Namespace).Create(ctx, desired, metav1.CreateOptions{})
+		if err != nil && !apierrors.IsAlreadyExists(err) {
+			logrus.WithFields(logfields).WithError(err).Warn("failed creating agent daemonset")
+		}
+		return
+	}
+
+	current := obj.(*appsv1.DaemonSet)
+	if current.Annotations[agentDaemonSetSpecHashAnnotation] == hash {
+		return
+	}
+
+	ds := current.DeepCopy()
+	if ds.Labels == nil {
+		ds.Labels = make(map[string]string)
+	}
+	for key, value := range desired.Labels {
+		ds.Labels[key] = value
+	}
+	if ds.Annotations == nil {
+		ds.Annotations = make(map[string]string)
+	}
+	ds.Annotations[agentDaemonSetSpecHashAnnotation] = hash
+
+	// the selector of a DaemonSet is immutable and kept as is.
+	selector := ds.Spec.Selector
+	ds.Spec = desired.Spec
+	ds.Spec.Selector = selector
+
+	// the config hash is kept, as it isn't part of the controller's config.
+	if hash, ok := current.Spec.Template.Annotations[configHashAnnotation]; ok {
+		ds.Spec.Template.Annotations = map[string]string{configHashAnnotation: hash}
+	}
+
+	logrus.WithFields(logfields).WithField("hash", hash).Info("updating agent daemonset")
+	if _, err := mgr.client.AppsV1().DaemonSets(ds.Namespace).Update(ctx, ds, metav1.UpdateOptions{}); err != nil {
+		logrus.WithFields(logfields).WithError(err).Warn("failed updating agent daemonset")
+	}
+}
+
+// watchAgentDaemonSet periodically syncs the agent DaemonSet using the
+// DaemonSet informer of the rollout.
+func (mgr *Manager) watchAgentDaemonSet(ctx context.Context) {
+	wait.UntilWithContext(ctx, mgr.syncAgentDaemonSet, rolloutSyncPeriod)
+}
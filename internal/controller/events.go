@@ -0,0 +1,53 @@
+package controller
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	reasonAgentTaintAdded   = "AgentTaintAdded"
+	reasonAgentTaintRemoved = "AgentTaintRemoved"
+)
+
+// nodeStateEventReasons maps node states to the reasons of events recorded
+// when a node transitions into them.
+var nodeStateEventReasons = map[nodeState]string{
+	nodeStatePending:  "RegistrarPending",
+	nodeStateReady:    "RegistrarReady",
+	nodeStateFailed:   "RegistrarFailed",
+	nodeStateDegraded: "RegistrarDegraded",
+	nodeStateSkipped:  "RegistrarSkipped",
+}
+
+// recordNodePatchEvents records events for the state transition and taint
+// changes of an applied node patch.
+func (mgr *Manager) recordNodePatchEvents(np *nodePatch) {
+	node := np.node
+	previous := nodeState(node.Annotations[nodeStateAnnotation])
+	if np.state != "" && np.state != previous {
+		if previous == "" {
+			previous = nodeStateNew
+		}
+
+		eventtype := corev1.EventTypeNormal
+		if np.state == nodeStateFailed || np.state == nodeStateDegraded {
+			eventtype = corev1.EventTypeWarning
+		}
+
+		message := fmt.Sprintf("Node state changed from %s to %s", previous, np.state)
+		if np.reason != "" {
+			message = fmt.Sprintf("%s: %s", message, np.reason)
+		}
+		mgr.recorder.Event(node, eventtype, nodeStateEventReasons[np.state], message)
+	}
+
+	if np.taintAdded {
+		mgr.recorder.Eventf(node, corev1.EventTypeNormal, reasonAgentTaintAdded, "Added agent taint %s", mgr.cfg.AgentNodeTaint)
+	}
+
+	if np.taintRemoved {
+		mgr.recorder.Eventf(node, corev1.EventTypeNormal, reasonAgentTaintRemoved, "Removed agent taint %s", mgr.cfg.AgentNodeTaint)
+	}
+}
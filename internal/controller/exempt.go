@@ -0,0 +1,94 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apitypes "k8s.io/apimachinery/pkg/types"
+)
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// isExemptPod reports whether the pod is exempt from the agent taint by its
+// namespace or priority class.
+func (mgr *Manager) isExemptPod(pod *corev1.Pod) bool {
+	return containsString(mgr.cfg.ExemptNamespaces, pod.Namespace) ||
+		(pod.Spec.PriorityClassName != "" && containsString(mgr.cfg.ExemptPriorityClasses, pod.Spec.PriorityClassName))
+}
+
+// getAgentToleration returns the toleration of the agent taint added to
+// exempt pods.
+func (mgr *Manager) getAgentToleration() corev1.Toleration {
+	taint := mgr.getAgentTaint()
+	return corev1.Toleration{
+		Key:      taint.Key,
+		Operator: corev1.TolerationOpEqual,
+		Value:    taint.Value,
+		Effect:   taint.Effect,
+	}
+}
+
+// needsExemptTolerations reports whether applying the patch evicts pods, as it
+// adds the agent taint with the NoExecute effect.
+func needsExemptTolerations(np *nodePatch) bool {
+	if np.taint == nil || np.taint.Effect != corev1.TaintEffectNoExecute {
+		return false
+	}
+
+	for _, taint := range np.node.Spec.Taints {
+		if taint.MatchTaint(np.taint) {
+			return false
+		}
+	}
+	return true
+}
+
+// tolerateExemptPods adds the agent taint's toleration to the exempt pods on
+// the node, which don't tolerate it yet, so they aren't evicted by the
+// NoExecute taint. Tolerations of existing pods can be added, but not removed.
+func (mgr *Manager) tolerateExemptPods(ctx context.Context, nodeName string) error {
+	pods, err := mgr.client.CoreV1().Pods("").List(ctx, metav1.ListOptions{
+		FieldSelector: "spec.nodeName=" + nodeName,
+	})
+	if err != nil {
+		return err
+	}
+
+	taint := mgr.getAgentTaint()
+	toleration := mgr.getAgentToleration()
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if !mgr.isExemptPod(pod) || toleratesTaint(pod.Spec.Tolerations, &taint) {
+			continue
+		}
+
+		p := patch{OP: "add", Path: "/spec/tolerations/-", Value: toleration}
+		if len(pod.Spec.Tolerations) == 0 {
+			p = patch{OP: "add", Path: "/spec/tolerations", Value: []corev1.Toleration{toleration}}
+		}
+
+		payload, err := json.Marshal([]patch{p})
+		if err != nil {
+			return err
+		}
+
+		logfields := logrus.Fields{"node": nodeName, "pod": pod.Namespace + "/" + pod.Name}
+		logrus.WithFields(logfields).Debug("adding agent taint toleration to exempt pod")
+		_, err = mgr.client.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, apitypes.JSONPatchType, payload, metav1.PatchOptions{})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
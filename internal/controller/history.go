@@ -0,0 +1,347 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	apitypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// ConfigRevisionLabelSelector matches the ControllerRevisions holding the
+	// history of the agent's registry config.
+	ConfigRevisionLabelSelector = "app.kubernetes.io/part-of=containerd-registrar,app.kubernetes.io/component=registry-config"
+
+	configRevisionNamePrefix = "containerd-registrar-config-"
+
+	ConfigRevisionResultRollingOut = "rolling-out"
+	ConfigRevisionResultRolledOut  = "rolled-out"
+	ConfigRevisionResultFailed     = "failed"
+)
+
+var (
+	configRevisionResultAnnotation          = "containerd-registrar.io/rollout-result"
+	configRevisionResultTimestampAnnotation = "containerd-registrar.io/rollout-result-timestamp"
+)
+
+func configRevisionLabels(hash string) map[string]string {
+	return map[string]string{
+		"app.kubernetes.io/part-of":   "containerd-registrar",
+		"app.kubernetes.io/component": "registry-config",
+		configHashAnnotation:          hash,
+	}
+}
+
+type configMapData struct {
+	Data       map[string]string `json:"data,omitempty"`
+	BinaryData map[string][]byte `json:"binaryData,omitempty"`
+}
+
+// configRevisionData is the content of a registry config revision. Secrets
+// aren't stored, as ControllerRevisions are readable by more subjects.
+type configRevisionData struct {
+	ConfigMaps map[string]configMapData `json:"configMaps"`
+}
+
+// ConfigRevision is a revision of the agent's registry config.
+type ConfigRevision struct {
+	Revision int64
+	Hash     string
+	Result   string
+	Created  time.Time
+	Updated  time.Time
+
+	ConfigMaps []string
+}
+
+func newConfigRevision(rev *appsv1.ControllerRevision) (*ConfigRevision, error) {
+	var data configRevisionData
+	if err := json.Unmarshal(rev.Data.Raw, &data); err != nil {
+		return nil, fmt.Errorf("decoding config revision %s: %s", rev.Name, err)
+	}
+
+	cr := &ConfigRevision{
+		Revision: rev.Revision,
+		Hash:     rev.Labels[configHashAnnotation],
+		Result:   rev.Annotations[configRevisionResultAnnotation],
+		Created:  rev.CreationTimestamp.Time,
+	}
+
+	if ts, err := time.Parse(time.RFC3339, rev.Annotations[configRevisionResultTimestampAnnotation]); err == nil {
+		cr.Updated = ts
+	}
+
+	for name := range data.ConfigMaps {
+		cr.ConfigMaps = append(cr.ConfigMaps, name)
+	}
+	sort.Strings(cr.ConfigMaps)
+
+	return cr, nil
+}
+
+// getConfigRevisions returns the registry config revisions from the informer
+// ordered by their revision number.
+func (mgr *Manager) getConfigRevisions() []*appsv1.ControllerRevision {
+	selector, _ := labels.Parse(ConfigRevisionLabelSelector)
+
+	var revs []*appsv1.ControllerRevision
+	for _, obj := range mgr.revisionInformer.GetStore().List() {
+		rev := obj.(*appsv1.ControllerRevision)
+		if selector.Matches(labels.Set(rev.Labels)) {
+			revs = append(revs, rev)
+		}
+	}
+
+	sort.Slice(revs, func(i, j int) bool {
+		return revs[i].Revision < revs[j].Revision
+	})
+	return revs
+}
+
+// recordConfigRevision stores the contents of the ConfigMaps referenced by
+// the pod spec as the latest registry config revision. If a revision with the
+// same hash exists, e.g. after a rollback, it becomes the latest revision.
+func (mgr *Manager) recordConfigRevision(ctx context.Context, spec *corev1.PodSpec, hash string) error {
+	var (
+		existing *appsv1.ControllerRevision
+		next     int64 = 1
+	)
+	for _, rev := range mgr.getConfigRevisions() {
+		if rev.Labels[configHashAnnotation] == hash {
+			existing = rev
+		}
+		next = rev.Revision + 1
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	annotations := map[string]string{
+		configRevisionResultAnnotation:          ConfigRevisionResultRollingOut,
+		configRevisionResultTimestampAnnotation: now,
+	}
+
+	revisions := mgr.client.AppsV1().ControllerRevisions(mgr.cfg.AgentPodNamespace)
+	if existing != nil {
+		rev := existing.DeepCopy()
+		rev.Revision = next
+		for key, value := range annotations {
+			metav1.SetMetaDataAnnotation(&rev.ObjectMeta, key, value)
+		}
+
+		_, err := revisions.Update(ctx, rev, metav1.UpdateOptions{})
+		return err
+	}
+
+	data := configRevisionData{ConfigMaps: make(map[string]configMapData)}
+	configMaps, _ := getReferencedConfig(spec)
+	for _, name := range configMaps {
+		obj, exists := getObjectFromStoreByKey(mgr.configMapInformer.GetStore(), mgr.cfg.AgentPodNamespace+"/"+name)
+		if !exists {
+			continue
+		}
+
+		cm := obj.(*corev1.ConfigMap)
+		data.ConfigMaps[name] = configMapData{Data: cm.Data, BinaryData: cm.BinaryData}
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = revisions.Create(ctx, &appsv1.ControllerRevision{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        configRevisionNamePrefix + hash,
+			Namespace:   mgr.cfg.AgentPodNamespace,
+			Labels:      configRevisionLabels(hash),
+			Annotations: annotations,
+		},
+		Data:     runtime.RawExtension{Raw: raw},
+		Revision: next,
+	}, metav1.CreateOptions{})
+	return err
+}
+
+// pruneConfigRevisions deletes the oldest registry config revisions exceeding
+// the history limit. The revision of the current hash is always kept.
+func (mgr *Manager) pruneConfigRevisions(ctx context.Context, current string) {
+	revs := mgr.getConfigRevisions()
+	if mgr.cfg.ConfigRevisionHistoryLimit <= 0 || len(revs) <= mgr.cfg.ConfigRevisionHistoryLimit {
+		return
+	}
+
+	excess := len(revs) - mgr.cfg.ConfigRevisionHistoryLimit
+	for _, rev := range revs {
+		if excess == 0 {
+			break
+		}
+
+		hash := rev.Labels[configHashAnnotation]
+		if hash == current {
+			continue
+		}
+
+		logfields := logrus.Fields{"hash": hash, "revision": rev.Revision}
+		err := mgr.client.AppsV1().ControllerRevisions(rev.Namespace).Delete(ctx, rev.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			logrus.WithFields(logfields).WithError(err).Warn("failed pruning config revision")
+			return
+		}
+
+		logrus.WithFields(logfields).Info("pruned config revision")
+		excess--
+	}
+}
+
+// setConfigRevisionResult records the rollout result of the registry config
+// revision with the given hash.
+func (mgr *Manager) setConfigRevisionResult(ctx context.Context, hash, result string) {
+	if hash == "" {
+		return
+	}
+
+	obj, exists := getObjectFromStoreByKey(mgr.revisionInformer.GetStore(), mgr.cfg.AgentPodNamespace+"/"+configRevisionNamePrefix+hash)
+	if !exists || obj.(*appsv1.ControllerRevision).Annotations[configRevisionResultAnnotation] == result {
+		return
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				configRevisionResultAnnotation:          result,
+				configRevisionResultTimestampAnnotation: time.Now().UTC().Format(time.RFC3339),
+			},
+		},
+	})
+	if err != nil {
+		return
+	}
+
+	logfields := logrus.Fields{"hash": hash, "result": result}
+	_, err = mgr.client.AppsV1().ControllerRevisions(mgr.cfg.AgentPodNamespace).Patch(ctx, configRevisionNamePrefix+hash, apitypes.MergePatchType, payload, metav1.PatchOptions{})
+	if err != nil {
+		logrus.WithFields(logfields).WithError(err).Warn("failed recording rollout result of config revision")
+		return
+	}
+	logrus.WithFields(logfields).Info("recorded rollout result of config revision")
+}
+
+// ListConfigRevisions returns the registry config revisions in the namespace
+// ordered by their revision number.
+func ListConfigRevisions(ctx context.Context, client kubernetes.Interface, namespace string) ([]*ConfigRevision, error) {
+	list, err := client.AppsV1().ControllerRevisions(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: ConfigRevisionLabelSelector,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var revs []*ConfigRevision
+	for i := range list.Items {
+		rev, err := newConfigRevision(&list.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		revs = append(revs, rev)
+	}
+
+	sort.Slice(revs, func(i, j int) bool {
+		return revs[i].Revision < revs[j].Revision
+	})
+	return revs, nil
+}
+
+// Rollback restores the ConfigMaps of the given registry config revision. The
+// controller picks up the changed contents and rolls them out like any other
+// config change. A failed rollout result of the revision is cleared, as the
+// controller doesn't roll out failed configs.
+func Rollback(ctx context.Context, client kubernetes.Interface, namespace string, revision int64) (*ConfigRevision, error) {
+	list, err := client.AppsV1().ControllerRevisions(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: ConfigRevisionLabelSelector,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var target *appsv1.ControllerRevision
+	for i := range list.Items {
+		if list.Items[i].Revision == revision {
+			target = &list.Items[i]
+		}
+	}
+
+	if target == nil {
+		return nil, fmt.Errorf("config revision %d not found", revision)
+	}
+
+	var data configRevisionData
+	if err := json.Unmarshal(target.Data.Raw, &data); err != nil {
+		return nil, fmt.Errorf("decoding config revision %d: %s", revision, err)
+	}
+
+	if target.Annotations[configRevisionResultAnnotation] == ConfigRevisionResultFailed {
+		if target, err = clearConfigRevisionResult(ctx, client, target); err != nil {
+			return nil, fmt.Errorf("clearing failed result of config revision %d: %s", revision, err)
+		}
+	}
+
+	configMaps := client.CoreV1().ConfigMaps(namespace)
+	for name, content := range data.ConfigMaps {
+		logfields := logrus.Fields{"configmap": namespace + "/" + name, "revision": revision}
+
+		cm, err := configMaps.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			logrus.WithFields(logfields).Info("creating configmap of config revision")
+			_, err = configMaps.Create(ctx, &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+				Data:       content.Data,
+				BinaryData: content.BinaryData,
+			}, metav1.CreateOptions{})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		logrus.WithFields(logfields).Info("restoring configmap of config revision")
+		cm.Data = content.Data
+		cm.BinaryData = content.BinaryData
+		if _, err := configMaps.Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+			return nil, err
+		}
+	}
+
+	return newConfigRevision(target)
+}
+
+// clearConfigRevisionResult resets the failed rollout result of the config
+// revision, so the controller rolls out its config again.
+func clearConfigRevisionResult(ctx context.Context, client kubernetes.Interface, rev *appsv1.ControllerRevision) (*appsv1.ControllerRevision, error) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				configRevisionResultAnnotation:          ConfigRevisionResultRollingOut,
+				configRevisionResultTimestampAnnotation: time.Now().UTC().Format(time.RFC3339),
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.WithFields(logrus.Fields{"hash": rev.Labels[configHashAnnotation], "revision": rev.Revision}).Info("clearing failed rollout result of config revision")
+	return client.AppsV1().ControllerRevisions(rev.Namespace).Patch(ctx, rev.Name, apitypes.MergePatchType, payload, metav1.PatchOptions{})
+}
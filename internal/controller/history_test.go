@@ -0,0 +1,56 @@
+package controller
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRollback(t *testing.T) {
+	const namespace = "kube-system"
+
+	data := []byte(`{"configMaps":{"registries":{"data":{"hosts.toml":"v1"}}}}`)
+	client := fake.NewSimpleClientset(
+		&appsv1.ControllerRevision{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        configRevisionNamePrefix + "a",
+				Namespace:   namespace,
+				Labels:      configRevisionLabels("a"),
+				Annotations: map[string]string{configRevisionResultAnnotation: ConfigRevisionResultFailed},
+			},
+			Data:     runtime.RawExtension{Raw: data},
+			Revision: 1,
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "registries", Namespace: namespace},
+			Data:       map[string]string{"hosts.toml": "v2"},
+		},
+	)
+
+	ctx := context.Background()
+	rev, err := Rollback(ctx, client, namespace, 1)
+	if err != nil {
+		t.Fatalf("Rollback() error = %s", err)
+	}
+	if rev.Result != ConfigRevisionResultRollingOut {
+		t.Errorf("Rollback() result = %s, want %s", rev.Result, ConfigRevisionResultRollingOut)
+	}
+
+	cm, err := client.CoreV1().ConfigMaps(namespace).Get(ctx, "registries", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("getting configmap: %s", err)
+	}
+	if want := map[string]string{"hosts.toml": "v1"}; !reflect.DeepEqual(cm.Data, want) {
+		t.Errorf("configmap data = %v, want %v", cm.Data, want)
+	}
+
+	if _, err := Rollback(ctx, client, namespace, 2); err == nil {
+		t.Error("Rollback() of missing revision error = nil, want error")
+	}
+}
@@ -0,0 +1,118 @@
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	appsinformers "k8s.io/client-go/informers/apps/v1"
+	coordinationinformers "k8s.io/client-go/informers/coordination/v1"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/xinau/containerd-registrar/internal/slots"
+)
+
+// setupInformers creates the manager's informers from the shared informer
+// factory. The factory holds a single informer per type, so informers with
+// custom filters are created through InformerFor.
+func (mgr *Manager) setupInformers() {
+	ns, indexers := mgr.cfg.AgentPodNamespace, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}
+
+	mgr.nodeInformer = mgr.factory.InformerFor(&corev1.Node{}, func(client kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+		return coreinformers.NewFilteredNodeInformer(client, resync, cache.Indexers{}, withLabelSelector(mgr.cfg.AgentNodeLabels))
+	})
+	mgr.podInformer = mgr.factory.InformerFor(&corev1.Pod{}, func(client kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+		return coreinformers.NewFilteredPodInformer(client, ns, resync, cache.Indexers{
+			cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+			nodeNameIndexer:      indexByNodeName,
+		}, func(opts *metav1.ListOptions) {
+			opts.LabelSelector = mgr.cfg.AgentPodLabels
+			opts.FieldSelector = notTerminatedPodsFieldSelector
+		})
+	})
+	mgr.daemonSetInformer = mgr.factory.InformerFor(&appsv1.DaemonSet{}, func(client kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+		return appsinformers.NewDaemonSetInformer(client, ns, resync, indexers)
+	})
+	mgr.revisionInformer = mgr.factory.InformerFor(&appsv1.ControllerRevision{}, func(client kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+		return appsinformers.NewControllerRevisionInformer(client, ns, resync, indexers)
+	})
+	mgr.configMapInformer = mgr.factory.InformerFor(&corev1.ConfigMap{}, func(client kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+		return coreinformers.NewConfigMapInformer(client, ns, resync, indexers)
+	})
+	mgr.leaseInformer = mgr.factory.InformerFor(&coordinationv1.Lease{}, func(client kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+		return coordinationinformers.NewFilteredLeaseInformer(client, ns, resync, indexers, withLabelSelector(slots.LabelSelector))
+	})
+
+	mgr.nodeMetadataInformer = mgr.metaFactory.ForResource(corev1.SchemeGroupVersion.WithResource("nodes")).Informer()
+
+	setTransform(mgr.nodeInformer, transformNode)
+	setTransform(mgr.podInformer, transformPod)
+	for _, informer := range []cache.SharedIndexInformer{
+		mgr.daemonSetInformer,
+		mgr.revisionInformer,
+		mgr.configMapInformer,
+		mgr.leaseInformer,
+		mgr.nodeMetadataInformer,
+	} {
+		setTransform(informer, stripManagedFields)
+	}
+
+	mgr.nodeInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: mgr.enqueueNode,
+		UpdateFunc: func(_, obj interface{}) {
+			mgr.enqueueNode(obj)
+		},
+	})
+	mgr.podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: mgr.enqueuePodNode,
+		UpdateFunc: func(_, obj interface{}) {
+			mgr.enqueuePodNode(obj)
+		},
+		DeleteFunc: mgr.enqueuePodNode,
+	})
+}
+
+// enqueueNode adds the node's name to the work queue.
+func (mgr *Manager) enqueueNode(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return
+	}
+	mgr.queue.Add(key)
+}
+
+// enqueuePodNode adds the name of the node the agent pod is bound to to the
+// work queue, so pod events are reconciled as node events.
+func (mgr *Manager) enqueuePodNode(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	pod, ok := obj.(*corev1.Pod)
+	if !ok || pod.Spec.NodeName == "" {
+		return
+	}
+	mgr.queue.Add(pod.Spec.NodeName)
+}
+
+// waitForCacheSync waits for the caches of all informers to be synced.
+func (mgr *Manager) waitForCacheSync(stopCh <-chan struct{}) error {
+	for typ, synced := range mgr.factory.WaitForCacheSync(stopCh) {
+		if !synced {
+			return fmt.Errorf("syncing %s informer cache", typ)
+		}
+	}
+
+	for gvr, synced := range mgr.metaFactory.WaitForCacheSync(stopCh) {
+		if !synced {
+			return fmt.Errorf("syncing %s metadata informer cache", gvr.Resource)
+		}
+	}
+
+	return nil
+}
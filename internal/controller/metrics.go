@@ -0,0 +1,179 @@
+package controller
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "containerd_registrar"
+
+var (
+	rolloutNodes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "rollout",
+		Name:      "nodes",
+		Help:      "Number of nodes by rollout state of the current agent revision.",
+	}, []string{"state"})
+
+	rolloutPaused = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "rollout",
+		Name:      "paused",
+		Help:      "Whether the rollout of the current agent revision is paused.",
+	})
+
+	rolloutPhases = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "rollout",
+		Name:      "phase",
+		Help:      "Current phase of the rollout of the current agent revision.",
+	}, []string{"phase"})
+
+	rolloutCanaryPullFailures = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "rollout",
+		Name:      "canary_pull_failures",
+		Help:      "Number of image pull and pod start failures on canary nodes.",
+	})
+
+	rolloutRollbacksTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "rollout",
+		Name:      "rollbacks_total",
+		Help:      "Total number of agent revisions rolled back after failing canary.",
+	})
+
+	rolloutUpdatedNodesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "rollout",
+		Name:      "updated_nodes_total",
+		Help:      "Total number of nodes updated to a new agent revision.",
+	})
+
+	rolloutNodeTimeoutsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "rollout",
+		Name:      "node_timeouts_total",
+		Help:      "Total number of nodes not becoming ready within the rollout deadline.",
+	})
+
+	pendingTimeoutsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "pending_timeouts_total",
+		Help:      "Total number of nodes whose agent didn't become ready within the pending timeout.",
+	}, []string{"policy"})
+
+	nodeTimeToReady = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "node",
+		Name:      "time_to_ready_seconds",
+		Help:      "Time nodes took from being gated to being marked as ready.",
+		Buckets:   prometheus.ExponentialBuckets(5, 2, 10),
+	})
+
+	agentDaemonSetConsistent = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "agent_daemonset",
+		Name:      "consistent",
+		Help:      "Whether the agent DaemonSet schedules onto all gated nodes and tolerates the agent taint.",
+	})
+
+	agentDaemonSetUnschedulableNodes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "agent_daemonset",
+		Name:      "unschedulable_nodes",
+		Help:      "Number of gated nodes the agent DaemonSet wouldn't schedule onto.",
+	})
+
+	breakGlassActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "break_glass",
+		Help:      "Whether break-glass is set, releasing all gated nodes.",
+	})
+
+	restartSlots = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "restart_slots",
+		Help:      "Number of containerd restart slots by state.",
+	}, []string{"state"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		rolloutNodes,
+		rolloutPaused,
+		rolloutPhases,
+		rolloutCanaryPullFailures,
+		rolloutRollbacksTotal,
+		rolloutUpdatedNodesTotal,
+		rolloutNodeTimeoutsTotal,
+		restartSlots,
+		pendingTimeoutsTotal,
+		nodeTimeToReady,
+		agentDaemonSetConsistent,
+		agentDaemonSetUnschedulableNodes,
+		breakGlassActive,
+	)
+}
+
+func setRolloutPhase(phase rolloutPhase) {
+	for _, p := range []rolloutPhase{rolloutPhaseCanary, rolloutPhaseBaking, rolloutPhasePromoted, rolloutPhaseFailed} {
+		if p == phase {
+			rolloutPhases.WithLabelValues(string(p)).Set(1)
+		} else {
+			rolloutPhases.WithLabelValues(string(p)).Set(0)
+		}
+	}
+}
+
+var nodeStatesDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(metricsNamespace, "", "nodes"),
+	"Number of managed nodes by state.",
+	[]string{"state"}, nil,
+)
+
+var staleAgentNodesDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(metricsNamespace, "", "stale_agent_nodes"),
+	"Number of managed nodes only running agents of an outdated revision.",
+	nil, nil,
+)
+
+// nodeStateCollector collects the number of nodes by state and the number of
+// nodes running stale agents at scrape time.
+type nodeStateCollector struct {
+	mgr *Manager
+}
+
+func (c *nodeStateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- nodeStatesDesc
+	ch <- staleAgentNodesDesc
+}
+
+func (c *nodeStateCollector) Collect(ch chan<- prometheus.Metric) {
+	mgr := c.mgr
+	if mgr.nodeInformer == nil || mgr.podInformer == nil {
+		return
+	}
+
+	counts := map[nodeState]int{
+		nodeStateNew:         0,
+		nodeStatePending:     0,
+		nodeStateInitialized: 0,
+		nodeStateReady:       0,
+		nodeStateDegraded:    0,
+		nodeStateFailed:      0,
+		nodeStateSkipped:     0,
+		nodeStateUnknown:     0,
+	}
+	var stale int
+	for _, node := range mgr.listNodes() {
+		counts[mgr.getNodeState(node)]++
+		if mgr.isStaleAgentRunning(node) {
+			stale++
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(staleAgentNodesDesc, prometheus.GaugeValue, float64(stale))
+
+	for state, count := range counts {
+		ch <- prometheus.MustNewConstMetric(nodeStatesDesc, prometheus.GaugeValue, float64(count), string(state))
+	}
+}
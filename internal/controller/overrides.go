@@ -0,0 +1,64 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+var (
+	skipAnnotation               = "node.containerd-registrar.io/skip"
+	reconcileRequestedAnnotation = "node.containerd-registrar.io/reconcile-requested"
+)
+
+const (
+	reasonReconcileRequested = "ReconcileRequested"
+	reasonReconcileIgnored   = "ReconcileIgnored"
+)
+
+// isSkipped reports whether the node opted out of being managed by the
+// registrar.
+func isSkipped(node *corev1.Node) bool {
+	return node.Annotations[skipAnnotation] == "true"
+}
+
+// reconcileNode handles a reconcile request by gating the node again and
+// deleting its agent pods, so the agent reapplies containerd's config. The
+// request annotation is cleared within the same patch. The pods are only
+// deleted once the node is gated, and errors are returned, so the request is
+// retried.
+func (mgr *Manager) reconcileNode(ctx context.Context, node *corev1.Node) error {
+	logfields := logrus.Fields{"node": node.Name}
+	if isSkipped(node) {
+		logrus.WithFields(logfields).Info("ignoring reconcile request for skipped node")
+
+		np := newNodePatch(node)
+		np.removeAnnotation(reconcileRequestedAnnotation)
+		if _, err := mgr.applyNodePatch(ctx, np); err != nil {
+			logrus.WithFields(logfields).WithError(err).Warn("failed clearing reconcile request")
+			return err
+		}
+
+		mgr.recorder.Event(node, corev1.EventTypeWarning, reasonReconcileIgnored, "Ignored reconcile request for skipped node")
+		return nil
+	}
+
+	logrus.WithFields(logfields).Info("reconciling node on request")
+	np := mgr.newNodeStatePatch(node, nodeStatePending, reasonReconcileRequested)
+	np.addTaint(mgr.getAgentTaintFor(node))
+	np.removeAgentResult()
+	np.removeAnnotation(reconcileRequestedAnnotation)
+	if _, err := mgr.applyNodePatch(ctx, np); err != nil {
+		logrus.WithFields(logfields).WithError(err).Warn("failed marking node as pending on reconcile request")
+		return err
+	}
+
+	if err := mgr.deleteAgentPods(ctx, mgr.getAgentPods(node.Name)); err != nil {
+		logrus.WithFields(logfields).WithError(err).Warn("failed deleting agent pods on reconcile request")
+		return err
+	}
+
+	mgr.recorder.Event(node, corev1.EventTypeNormal, reasonReconcileRequested, "Gated node and deleted agent pods on reconcile request")
+	return nil
+}
@@ -0,0 +1,62 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	PendingTimeoutPolicyFailClosed = "fail-closed"
+	PendingTimeoutPolicyFailOpen   = "fail-open"
+
+	reasonPendingTimeout = "PendingTimeout"
+)
+
+// checkPendingTimeout handles nodes whose agent didn't become ready within the
+// pending timeout. Depending on the policy the node either stays tainted or
+// gets released with a degraded state. Failed nodes are already tainted and
+// reported, so they're only handled by the fail-open policy. It returns the
+// node and its state after applying the policy.
+func (mgr *Manager) checkPendingTimeout(ctx context.Context, node *corev1.Node, state nodeState) (*corev1.Node, nodeState) {
+	if mgr.cfg.PendingTimeout <= 0 || node.Annotations[nodeStateReasonAnnotation] == reasonPendingTimeout {
+		return node, state
+	}
+
+	if state == nodeStateFailed && mgr.cfg.PendingTimeoutPolicy != PendingTimeoutPolicyFailOpen {
+		return node, state
+	}
+
+	since := getNodeStateTimestamp(node)
+	if time.Since(since) < mgr.cfg.PendingTimeout {
+		return node, state
+	}
+
+	logfields := logrus.Fields{"node": node.Name, "policy": mgr.cfg.PendingTimeoutPolicy, "pending.since": since}
+	logrus.WithFields(logfields).Warn("agent didn't become ready within pending timeout")
+	mgr.recorder.Eventf(node, corev1.EventTypeWarning, reasonPendingTimeout,
+		"Registrar agent didn't become ready within %s, applying %s policy", mgr.cfg.PendingTimeout, mgr.cfg.PendingTimeoutPolicy)
+	pendingTimeoutsTotal.WithLabelValues(mgr.cfg.PendingTimeoutPolicy).Inc()
+
+	var (
+		updated *corev1.Node
+		err     error
+	)
+	written := nodeStatePending
+	switch mgr.cfg.PendingTimeoutPolicy {
+	case PendingTimeoutPolicyFailOpen:
+		written = nodeStateDegraded
+		updated, err = mgr.markNodeAsDegraded(ctx, node, reasonPendingTimeout)
+	default:
+		np := mgr.newNodeStatePatch(node, nodeStatePending, reasonPendingTimeout)
+		updated, err = mgr.applyNodePatch(ctx, np)
+	}
+
+	if err != nil {
+		logrus.WithFields(logfields).WithError(err).Warn("failed applying pending timeout policy")
+		return node, state
+	}
+	return updated, written
+}
@@ -3,38 +3,20 @@ package controller
 import (
 	"context"
 
-	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/workqueue"
 )
 
 type QueueEventHandler struct {
-	workqueue.Interface
+	workqueue.RateLimitingInterface
 }
 
-var queueKeyFunc = cache.DeletionHandlingMetaNamespaceKeyFunc
-
-func NewQueueEventHandler() QueueEventHandler {
-	return QueueEventHandler{workqueue.New()}
-}
-
-func (qeh *QueueEventHandler) GetEventHandler() cache.ResourceEventHandler {
-	return cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj interface{}) {
-			key, _ := queueKeyFunc(obj)
-			qeh.Add(key)
-		},
-		UpdateFunc: func(_, obj interface{}) {
-			key, _ := queueKeyFunc(obj)
-			qeh.Add(key)
-		},
-		DeleteFunc: func(obj interface{}) {
-			key, _ := queueKeyFunc(obj)
-			qeh.Done(key)
-		},
-	}
+func NewQueueEventHandler(name string) QueueEventHandler {
+	return QueueEventHandler{workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), name)}
 }
 
-func (qeh *QueueEventHandler) ProcessNextKey(ctx context.Context, process func(context.Context, interface{}) bool) bool {
+// ProcessNextKey processes the next key from the queue. Keys failing to be
+// processed are requeued with backoff.
+func (qeh *QueueEventHandler) ProcessNextKey(ctx context.Context, process func(context.Context, interface{}) error) bool {
 	if ctx.Err() != nil {
 		return false
 	}
@@ -46,5 +28,11 @@ func (qeh *QueueEventHandler) ProcessNextKey(ctx context.Context, process func(c
 
 	defer qeh.Done(key)
 
-	return process(ctx, key)
+	if err := process(ctx, key); err != nil {
+		qeh.AddRateLimited(key)
+		return ctx.Err() == nil
+	}
+
+	qeh.Forget(key)
+	return ctx.Err() == nil
 }
@@ -0,0 +1,185 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/xinau/containerd-registrar/internal/result"
+)
+
+const reasonRegistrarReleased = "RegistrarReleased"
+
+// syncNodeStateLabel mirrors the node state annotation into the node state
+// label, e.g. for nodes managed before the label was configured.
+func (mgr *Manager) syncNodeStateLabel(ctx context.Context, node *corev1.Node) {
+	state, ok := node.Annotations[nodeStateAnnotation]
+	if mgr.cfg.NodeStateLabel == "" || !ok || node.Labels[mgr.cfg.NodeStateLabel] == state {
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{"node": node.Name, "label": mgr.cfg.NodeStateLabel}).Debug("updating node state label")
+
+	np := newNodePatch(node)
+	np.setLabel(mgr.cfg.NodeStateLabel, state)
+	if _, err := mgr.applyNodePatch(ctx, np); err != nil {
+		logrus.WithField("node", node.Name).WithError(err).Warn("failed updating node state label")
+	}
+}
+
+// hasRegistrarState reports whether the node carries any of the taint,
+// annotations, label or condition managed by the registrar.
+func (mgr *Manager) hasRegistrarState(node *corev1.Node) bool {
+	for _, key := range []string{managedByAnnotation, nodeStateAnnotation, result.Annotation} {
+		if _, ok := node.Annotations[key]; ok {
+			return true
+		}
+	}
+
+	if _, ok := node.Labels[mgr.cfg.NodeStateLabel]; ok && mgr.cfg.NodeStateLabel != "" {
+		return true
+	}
+
+	return hasTaintWithKey(node, mgr.cfg.AgentNodeTaint) || getNodeCondition(node, nodeConditionType) != nil
+}
+
+// newReleasePatch returns a patch removing the registrar's taint, annotations
+// and label from the node.
+func (mgr *Manager) newReleasePatch(node *corev1.Node) *nodePatch {
+	np := newNodePatch(node)
+	for _, key := range []string{
+		managedByAnnotation,
+		nodeStateAnnotation,
+		nodeStateReasonAnnotation,
+		nodeStateTimestampAnnotation,
+		nodeStateHistoryAnnotation,
+		bootIDAnnotation,
+		result.Annotation,
+		result.MessageAnnotation,
+	} {
+		np.removeAnnotation(key)
+	}
+
+	if mgr.cfg.NodeStateLabel != "" {
+		np.removeLabel(mgr.cfg.NodeStateLabel)
+	}
+
+	if hasTaintWithKey(node, mgr.cfg.AgentNodeTaint) {
+		np.removeTaint(mgr.cfg.AgentNodeTaint)
+	}
+
+	return np
+}
+
+func (mgr *Manager) removeNodeCondition(ctx context.Context, node *corev1.Node) error {
+	if getNodeCondition(node, nodeConditionType) == nil {
+		return nil
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []map[string]interface{}{{
+				"type":   nodeConditionType,
+				"$patch": "delete",
+			}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = mgr.client.CoreV1().Nodes().PatchStatus(ctx, node.Name, payload)
+	return err
+}
+
+// isReleasable reports whether a node has been managed by the registrar, but
+// doesn't match the agent node labels anymore.
+func isReleasable(obj metav1.Object, selector labels.Selector) bool {
+	_, managed := obj.GetAnnotations()[managedByAnnotation]
+	_, hasState := obj.GetAnnotations()[nodeStateAnnotation]
+	return (managed || hasState) && !selector.Matches(labels.Set(obj.GetLabels()))
+}
+
+// releaseNode removes the registrar's state from a node, which isn't managed
+// anymore. Nodes which have been deleted or are matching the agent node
+// labels again are ignored.
+func (mgr *Manager) releaseNode(ctx context.Context, name string, selector labels.Selector) error {
+	node, err := mgr.client.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+
+	logfields := logrus.Fields{"node": name}
+	if err != nil {
+		logrus.WithFields(logfields).WithError(err).Warn("failed getting node to release")
+		return err
+	}
+
+	if selector.Matches(labels.Set(node.Labels)) || !mgr.hasRegistrarState(node) {
+		return nil
+	}
+
+	logrus.WithFields(logfields).Info("releasing node not managed anymore")
+	if err := mgr.removeRegistrarState(ctx, node); err != nil {
+		logrus.WithFields(logfields).WithError(err).Warn("failed releasing node")
+		return err
+	}
+
+	mgr.recorder.Event(node, corev1.EventTypeNormal, reasonRegistrarReleased, "Removed registrar state from node not managed anymore")
+	return nil
+}
+
+// removeRegistrarState removes the registrar's taint, annotations, label and
+// condition from the node.
+func (mgr *Manager) removeRegistrarState(ctx context.Context, node *corev1.Node) error {
+	if _, err := mgr.applyNodePatch(ctx, mgr.newReleasePatch(node)); err != nil {
+		return err
+	}
+
+	return mgr.removeNodeCondition(ctx, node)
+}
+
+// watchReleasedNodes watches the metadata of all nodes, as nodes which stop
+// matching the agent node labels vanish from the node informer.
+func (mgr *Manager) watchReleasedNodes(ctx context.Context) {
+	selector, err := labels.Parse(mgr.cfg.AgentNodeLabels)
+	if err != nil {
+		logrus.WithField("selector", mgr.cfg.AgentNodeLabels).WithError(err).Error("parsing agent node labels")
+		return
+	}
+
+	queue := NewQueueEventHandler("released-nodes")
+	go func() {
+		<-ctx.Done()
+		queue.ShutDown()
+	}()
+
+	enqueue := func(obj interface{}) {
+		accessor, err := meta.Accessor(obj)
+		if err != nil || !isReleasable(accessor, selector) {
+			return
+		}
+
+		logrus.WithField("node", accessor.GetName()).Debug("node stopped matching agent node labels")
+		queue.Add(accessor.GetName())
+	}
+	mgr.nodeMetadataInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: enqueue,
+		UpdateFunc: func(_, obj interface{}) {
+			enqueue(obj)
+		},
+	})
+
+	process := func(ctx context.Context, key interface{}) error {
+		return mgr.releaseNode(ctx, key.(string), selector)
+	}
+	for queue.ProcessNextKey(ctx, process) {
+	}
+}
@@ -0,0 +1,72 @@
+package controller
+
+import (
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func isPodReady(pod *corev1.Pod) bool {
+	return isPodReadySince(pod, time.Time{})
+}
+
+// isPodReadySince reports whether the pod is ready and became ready since the
+// given time.
+func isPodReadySince(pod *corev1.Pod, since time.Time) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady && cond.Status == corev1.ConditionTrue {
+			return !cond.LastTransitionTime.Time.Before(since)
+		}
+	}
+	return false
+}
+
+// getAgentPodsReadyBefore returns the node's agent pods, which are ready, but
+// became ready before the given time.
+func (mgr *Manager) getAgentPodsReadyBefore(nodeName string, since time.Time) []*corev1.Pod {
+	var pods []*corev1.Pod
+	for _, pod := range mgr.getAgentPods(nodeName) {
+		if isPodReady(pod) && !isPodReadySince(pod, since) {
+			pods = append(pods, pod)
+		}
+	}
+	return pods
+}
+
+// getCurrentAgentRevision returns the current revision of the DaemonSet
+// controlling the agent pod. It returns an empty string, if the DaemonSet or
+// its revisions aren't known (yet).
+func (mgr *Manager) getCurrentAgentRevision(pod *corev1.Pod) string {
+	if !mgr.daemonSetInformer.HasSynced() || !mgr.revisionInformer.HasSynced() {
+		return ""
+	}
+
+	ref := metav1.GetControllerOf(pod)
+	if ref == nil || ref.Kind != "DaemonSet" {
+		return ""
+	}
+
+	obj, exists := getObjectFromStoreByKey(mgr.daemonSetInformer.GetStore(), pod.Namespace+"/"+ref.Name)
+	if !exists {
+		return ""
+	}
+
+	revision, _ := mgr.getCurrentRevision(obj.(*appsv1.DaemonSet))
+	return revision
+}
+
+// isCurrentAgentPod reports whether the agent pod is of its DaemonSet's
+// current revision. Pods are considered current, if the revision isn't known.
+func (mgr *Manager) isCurrentAgentPod(pod *corev1.Pod) bool {
+	revision := mgr.getCurrentAgentRevision(pod)
+	return revision == "" || pod.Labels[appsv1.DefaultDaemonSetUniqueLabelKey] == revision
+}
+
+// isStaleAgentRunning reports whether the node only runs ready agent pods of
+// an outdated revision.
+func (mgr *Manager) isStaleAgentRunning(node *corev1.Node) bool {
+	running, current := mgr.isAgentRunning(node.Name, getAgentReadySince(node))
+	return running && !current
+}
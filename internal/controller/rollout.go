@@ -0,0 +1,517 @@
+package controller
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apitypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+)
+
+var rolloutSyncPeriod = 10 * time.Second
+
+type rolloutPhase string
+
+const (
+	rolloutPhaseCanary   rolloutPhase = "canary"
+	rolloutPhaseBaking   rolloutPhase = "baking"
+	rolloutPhasePromoted rolloutPhase = "promoted"
+	rolloutPhaseFailed   rolloutPhase = "failed"
+)
+
+// rollout tracks the progress of replacing outdated agent pods with pods of
+// the agent DaemonSet's current revision. It's only accessed by the rollout
+// loop and therefore isn't synchronized.
+type rollout struct {
+	revision string
+	phase    rolloutPhase
+	started  time.Time
+	baked    time.Time
+	canaries map[string]bool
+	updating map[string]time.Time
+	timedOut map[string]bool
+	paused   bool
+
+	// unhealthy holds updating nodes which became failed or degraded. They
+	// pause the rollout right away.
+	unhealthy map[string]bool
+
+	// events caches the warning events of pods during the canary phase.
+	events     cache.SharedIndexInformer
+	stopEvents chan struct{}
+
+	// failed and promoted hold revisions which failed or passed the canary
+	// phase and are kept across rollouts.
+	failed   map[string]bool
+	promoted map[string]bool
+
+	// failedConfigHashes hold the config hashes of revisions which failed the
+	// canary phase, with the resource version their config revision had
+	// before.
+	failedConfigHashes map[string]string
+}
+
+func newRollout() *rollout {
+	return &rollout{
+		canaries: make(map[string]bool),
+		updating: make(map[string]time.Time),
+		timedOut: make(map[string]bool),
+		failed:   make(map[string]bool),
+		promoted: make(map[string]bool),
+
+		unhealthy: make(map[string]bool),
+
+		failedConfigHashes: make(map[string]string),
+	}
+}
+
+func (ro *rollout) reset(revision string) {
+	ro.revision = revision
+	ro.phase = ""
+	ro.started = time.Now()
+	ro.baked = time.Time{}
+	ro.canaries = make(map[string]bool)
+	ro.updating = make(map[string]time.Time)
+	ro.timedOut = make(map[string]bool)
+	ro.unhealthy = make(map[string]bool)
+	ro.paused = false
+	ro.stopCanaryEvents()
+}
+
+func (ro *rollout) isCanaryUpdating() bool {
+	for name := range ro.updating {
+		if ro.canaries[name] {
+			return true
+		}
+	}
+	return false
+}
+
+func (mgr *Manager) hasSynced() bool {
+	for _, informer := range []cache.SharedIndexInformer{
+		mgr.nodeInformer,
+		mgr.podInformer,
+		mgr.daemonSetInformer,
+		mgr.revisionInformer,
+	} {
+		if !informer.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// getAgentDaemonSet returns the DaemonSet controlling the agent pods.
+func (mgr *Manager) getAgentDaemonSet() (*appsv1.DaemonSet, bool) {
+	for _, obj := range mgr.podInformer.GetStore().List() {
+		pod := obj.(*corev1.Pod)
+		ref := metav1.GetControllerOf(pod)
+		if ref == nil || ref.Kind != "DaemonSet" {
+			continue
+		}
+
+		obj, exists := getObjectFromStoreByKey(mgr.daemonSetInformer.GetStore(), pod.Namespace+"/"+ref.Name)
+		if !exists {
+			continue
+		}
+
+		return obj.(*appsv1.DaemonSet), true
+	}
+
+	return nil, false
+}
+
+// getRevisions returns the DaemonSet's ControllerRevisions ordered by their
+// revision number.
+func (mgr *Manager) getRevisions(ds *appsv1.DaemonSet) []*appsv1.ControllerRevision {
+	var revs []*appsv1.ControllerRevision
+	for _, obj := range mgr.revisionInformer.GetStore().List() {
+		rev := obj.(*appsv1.ControllerRevision)
+		if metav1.IsControlledBy(rev, ds) {
+			revs = append(revs, rev)
+		}
+	}
+
+	sort.Slice(revs, func(i, j int) bool {
+		return revs[i].Revision < revs[j].Revision
+	})
+	return revs
+}
+
+// getCurrentRevision returns the controller-revision-hash of the DaemonSet's
+// ControllerRevision with the highest revision number.
+func (mgr *Manager) getCurrentRevision(ds *appsv1.DaemonSet) (string, bool) {
+	revs := mgr.getRevisions(ds)
+	if len(revs) == 0 {
+		return "", false
+	}
+
+	hash, ok := revs[len(revs)-1].Labels[appsv1.DefaultDaemonSetUniqueLabelKey]
+	return hash, ok
+}
+
+// rollbackRollout reverts the DaemonSet's pod template to the latest revision
+// other than the current one, the same way `kubectl rollout undo` does.
+func (mgr *Manager) rollbackRollout(ctx context.Context, ds *appsv1.DaemonSet, logfields logrus.Fields) {
+	ro := mgr.rollout
+	ro.phase = rolloutPhaseFailed
+	ro.failed[ro.revision] = true
+	ro.stopCanaryEvents()
+	rolloutRollbacksTotal.Inc()
+
+	revs := mgr.getRevisions(ds)
+	var previous *appsv1.ControllerRevision
+	for i := len(revs) - 1; i >= 0; i-- {
+		if revs[i].Labels[appsv1.DefaultDaemonSetUniqueLabelKey] != ro.revision {
+			previous = revs[i]
+			break
+		}
+	}
+	mgr.recordFailedConfig(ctx, ds, previous)
+
+	if previous == nil {
+		logrus.WithFields(logfields).Error("no previous agent revision found to roll back to")
+		return
+	}
+
+	hash := previous.Labels[appsv1.DefaultDaemonSetUniqueLabelKey]
+	logrus.WithFields(logfields).WithField("revision.previous", hash).Warn("rolling back agent revision")
+
+	_, err := mgr.client.AppsV1().DaemonSets(ds.Namespace).Patch(ctx, ds.Name, apitypes.StrategicMergePatchType, previous.Data.Raw, metav1.PatchOptions{})
+	if err != nil {
+		logrus.WithFields(logfields).WithField("revision.previous", hash).WithError(err).Error("failed rolling back agent revision")
+		return
+	}
+
+	ro.promoted[hash] = true
+}
+
+func (mgr *Manager) getOutdatedAgentPods(nodeName, revision string) []*corev1.Pod {
+	var pods []*corev1.Pod
+	for _, pod := range mgr.getAgentPods(nodeName) {
+		if pod.Labels[appsv1.DefaultDaemonSetUniqueLabelKey] != revision {
+			pods = append(pods, pod)
+		}
+	}
+	return pods
+}
+
+func (mgr *Manager) listNodes() []*corev1.Node {
+	var nodes []*corev1.Node
+	for _, obj := range mgr.nodeInformer.GetStore().List() {
+		nodes = append(nodes, obj.(*corev1.Node))
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Name < nodes[j].Name
+	})
+	return nodes
+}
+
+// deleteAgentPods deletes the given agent pods, so they get recreated by the
+// DaemonSet.
+func (mgr *Manager) deleteAgentPods(ctx context.Context, pods []*corev1.Pod) error {
+	for _, pod := range pods {
+		err := mgr.client.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &pod.UID},
+		})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateNode gates the node and deletes its outdated agent pods, so they get
+// recreated by the DaemonSet using the current revision. The pods are only
+// deleted once the node is gated, so containerd never restarts on a node
+// without the agent taint.
+func (mgr *Manager) updateNode(ctx context.Context, node *corev1.Node, pods []*corev1.Pod) error {
+	if _, err := mgr.markNodeAsPending(ctx, node, ""); err != nil {
+		return err
+	}
+
+	return mgr.deleteAgentPods(ctx, pods)
+}
+
+// getMaxUnavailable returns the number of nodes allowed to be unavailable
+// during the rollout, scaled by the number of managed nodes. At least one
+// node is always allowed, so rollouts make progress.
+func getMaxUnavailable(maxUnavailable intstr.IntOrString, managed int) (int, error) {
+	value, err := intstr.GetScaledValueFromIntOrPercent(&maxUnavailable, managed, true)
+	if err != nil {
+		return 0, err
+	}
+
+	if value < 1 {
+		value = 1
+	}
+	return value, nil
+}
+
+func (mgr *Manager) syncRollout(ctx context.Context) {
+	if !mgr.hasSynced() {
+		return
+	}
+
+	if mgr.isBreakGlass() {
+		logrus.Debug("break-glass is set, skipping rollout")
+		return
+	}
+
+	ds, ok := mgr.getAgentDaemonSet()
+	if !ok {
+		logrus.Debug("agent daemonset not found")
+		return
+	}
+
+	logfields := logrus.Fields{"daemonset": ds.Namespace + "/" + ds.Name}
+	if ds.Spec.UpdateStrategy.Type != appsv1.OnDeleteDaemonSetStrategyType {
+		logrus.WithFields(logfields).Debug("agent daemonset isn't using OnDelete update strategy, skipping rollout")
+		return
+	}
+
+	revision, ok := mgr.getCurrentRevision(ds)
+	if !ok {
+		logrus.WithFields(logfields).Debug("current agent daemonset revision not found")
+		return
+	}
+	logfields["revision"] = revision
+
+	ro := mgr.rollout
+	if ro.revision != revision {
+		logrus.WithFields(logfields).Info("starting rollout of agent revision")
+		ro.reset(revision)
+	}
+
+	if ro.failed[revision] {
+		logrus.WithFields(logfields).Debug("agent revision failed canary, skipping rollout")
+		ro.phase = rolloutPhaseFailed
+		setRolloutPhase(ro.phase)
+		return
+	}
+
+	nodes := mgr.listNodes()
+	names := make(map[string]bool, len(nodes))
+	zones := make(map[string]int)
+	var unavailable, managed int
+	var outdated []*corev1.Node
+	for _, node := range nodes {
+		names[node.Name] = true
+		zone := node.Labels[corev1.LabelTopologyZone]
+		state := mgr.getNodeState(node)
+		if state == nodeStateSkipped {
+			delete(ro.updating, node.Name)
+			delete(ro.timedOut, node.Name)
+			delete(ro.unhealthy, node.Name)
+			continue
+		}
+		managed++
+
+		if started, ok := ro.updating[node.Name]; ok {
+			if state == nodeStateReady && len(mgr.getOutdatedAgentPods(node.Name, revision)) == 0 {
+				logrus.WithFields(logfields).WithField("node", node.Name).Info("node updated to agent revision")
+				delete(ro.updating, node.Name)
+				delete(ro.timedOut, node.Name)
+				delete(ro.unhealthy, node.Name)
+				rolloutUpdatedNodesTotal.Inc()
+				continue
+			}
+
+			if state == nodeStateFailed || state == nodeStateDegraded {
+				if !ro.unhealthy[node.Name] {
+					logrus.WithFields(logfields).WithFields(logrus.Fields{"node": node.Name, "state": state}).Warn("node became unhealthy during rollout")
+					ro.unhealthy[node.Name] = true
+				}
+			} else {
+				delete(ro.unhealthy, node.Name)
+			}
+
+			if time.Since(started) > mgr.cfg.RolloutReadyTimeout && !ro.timedOut[node.Name] {
+				logrus.WithFields(logfields).WithField("node", node.Name).Warn("node didn't become ready within rollout deadline")
+				ro.timedOut[node.Name] = true
+				rolloutNodeTimeoutsTotal.Inc()
+			}
+		}
+
+		// gated nodes are only released by an agent of the current revision,
+		// so their outdated agent pods are deleted right away.
+		if state != nodeStateReady && hasTaintWithKey(node, mgr.cfg.AgentNodeTaint) {
+			if pods := mgr.getOutdatedAgentPods(node.Name, revision); len(pods) > 0 {
+				logrus.WithFields(logfields).WithField("node", node.Name).Info("deleting outdated agent pods on gated node")
+				if err := mgr.deleteAgentPods(ctx, pods); err != nil {
+					logrus.WithFields(logfields).WithField("node", node.Name).WithError(err).Warn("failed deleting outdated agent pods")
+				}
+			}
+		}
+
+		// nodes being updated count against the unavailable nodes whatever
+		// their state, so a revision breaking nodes doesn't spread. Other
+		// degraded and failed nodes aren't updated by the rollout, so they
+		// don't count.
+		if _, ok := ro.updating[node.Name]; ok {
+			unavailable++
+			zones[zone]++
+			continue
+		}
+
+		switch state {
+		case nodeStateReady:
+		case nodeStateDegraded, nodeStateFailed:
+			continue
+		default:
+			unavailable++
+			zones[zone]++
+			continue
+		}
+
+		if len(mgr.getOutdatedAgentPods(node.Name, revision)) > 0 {
+			outdated = append(outdated, node)
+		}
+	}
+
+	for name := range ro.updating {
+		if !names[name] {
+			delete(ro.updating, name)
+			delete(ro.timedOut, name)
+			delete(ro.unhealthy, name)
+		}
+	}
+
+	if paused := len(ro.timedOut) > 0 || len(ro.unhealthy) > 0; paused != ro.paused {
+		ro.paused = paused
+		if paused {
+			logrus.WithFields(logfields).Warn("pausing rollout of agent revision")
+		} else {
+			logrus.WithFields(logfields).Info("resuming rollout of agent revision")
+		}
+	}
+
+	if ro.phase == "" {
+		ro.phase = rolloutPhasePromoted
+		if !ro.promoted[revision] && len(outdated) > 0 {
+			ro.canaries = mgr.selectCanaries(outdated)
+			if len(ro.canaries) > 0 {
+				logrus.WithFields(logfields).WithField("nodes.canaries", len(ro.canaries)).Info("starting canary phase of agent revision")
+				ro.phase = rolloutPhaseCanary
+				mgr.watchCanaryEvents()
+			}
+		}
+	}
+
+	candidates := outdated
+	switch ro.phase {
+	case rolloutPhaseCanary:
+		if ro.paused {
+			logrus.WithFields(logfields).Warn("canary nodes didn't become ready")
+			mgr.rollbackRollout(ctx, ds, logfields)
+			setRolloutPhase(ro.phase)
+			return
+		}
+
+		candidates = nil
+		for _, node := range outdated {
+			if ro.canaries[node.Name] {
+				candidates = append(candidates, node)
+			}
+		}
+
+		if len(candidates) == 0 && !ro.isCanaryUpdating() {
+			logrus.WithFields(logfields).WithField("bake-time", mgr.cfg.CanaryBakeTime).Info("canary nodes updated, baking agent revision")
+			ro.phase = rolloutPhaseBaking
+			ro.baked = time.Now()
+		}
+	case rolloutPhaseBaking:
+		candidates = nil
+
+		failures, ok := mgr.countPullFailures(ro.canaries, ro.started)
+		if !ok {
+			logrus.WithFields(logfields).Debug("waiting for events of canary nodes")
+			return
+		}
+		rolloutCanaryPullFailures.Set(float64(failures))
+
+		if failures > mgr.cfg.CanaryMaxPullFailures {
+			logrus.WithFields(logfields).WithField("failures", failures).Warn("canary nodes are failing to pull images")
+			mgr.rollbackRollout(ctx, ds, logfields)
+			setRolloutPhase(ro.phase)
+			return
+		}
+
+		if time.Since(ro.baked) >= mgr.cfg.CanaryBakeTime {
+			logrus.WithFields(logfields).Info("canary nodes are healthy, promoting agent revision")
+			ro.phase = rolloutPhasePromoted
+			ro.promoted[revision] = true
+			ro.stopCanaryEvents()
+			candidates = outdated
+		}
+	}
+
+	maxUnavailable, err := getMaxUnavailable(mgr.cfg.RolloutMaxUnavailable, managed)
+	if err != nil {
+		logrus.WithFields(logfields).WithError(err).Error("getting max unavailable nodes")
+		return
+	}
+
+	for _, node := range candidates {
+		if ro.paused || unavailable >= maxUnavailable {
+			break
+		}
+
+		zone := node.Labels[corev1.LabelTopologyZone]
+		if mgr.cfg.RolloutMaxUnavailablePerZone > 0 && zones[zone] >= mgr.cfg.RolloutMaxUnavailablePerZone {
+			continue
+		}
+
+		logrus.WithFields(logfields).WithField("node", node.Name).Info("updating node to agent revision")
+		if err := mgr.updateNode(ctx, node, mgr.getOutdatedAgentPods(node.Name, revision)); err != nil {
+			logrus.WithFields(logfields).WithField("node", node.Name).WithError(err).Warn("failed updating node to agent revision")
+			continue
+		}
+
+		ro.updating[node.Name] = time.Now()
+		unavailable++
+		zones[zone]++
+	}
+
+	setRolloutPhase(ro.phase)
+	rolloutNodes.WithLabelValues("outdated").Set(float64(len(outdated)))
+	rolloutNodes.WithLabelValues("updating").Set(float64(len(ro.updating)))
+	rolloutNodes.WithLabelValues("unavailable").Set(float64(unavailable))
+	if ro.paused {
+		rolloutPaused.Set(1)
+	} else {
+		rolloutPaused.Set(0)
+	}
+
+	if len(outdated) == 0 && len(ro.updating) == 0 && ro.phase == rolloutPhasePromoted {
+		mgr.setConfigRevisionResult(ctx, ds.Spec.Template.Annotations[configHashAnnotation], ConfigRevisionResultRolledOut)
+	}
+
+	if len(outdated) > 0 || len(ro.updating) > 0 {
+		logfields["phase"] = ro.phase
+		logfields["nodes.outdated"] = len(outdated)
+		logfields["nodes.updating"] = len(ro.updating)
+		logfields["nodes.unavailable"] = unavailable
+		logfields["nodes.max-unavailable"] = maxUnavailable
+		logrus.WithFields(logfields).Info("rollout of agent revision in progress")
+	}
+}
+
+func (mgr *Manager) watchRollout(ctx context.Context) {
+	// the config hash is synced by the rollout loop, as it depends on the
+	// rollout's failed config hashes.
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		mgr.syncConfigHash(ctx)
+		mgr.syncRollout(ctx)
+	}, rolloutSyncPeriod)
+}
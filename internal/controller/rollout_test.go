@@ -0,0 +1,177 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/xinau/containerd-registrar/internal/result"
+)
+
+func TestGetMaxUnavailable(t *testing.T) {
+	tests := []struct {
+		name           string
+		maxUnavailable intstr.IntOrString
+		managed        int
+		want           int
+		wantErr        bool
+	}{
+		{name: "integer", maxUnavailable: intstr.FromInt(2), managed: 10, want: 2},
+		{name: "integer exceeding nodes", maxUnavailable: intstr.FromInt(20), managed: 10, want: 20},
+		{name: "zero is raised to one", maxUnavailable: intstr.FromInt(0), managed: 10, want: 1},
+		{name: "percentage", maxUnavailable: intstr.FromString("20%"), managed: 10, want: 2},
+		{name: "percentage rounds up", maxUnavailable: intstr.FromString("25%"), managed: 10, want: 3},
+		{name: "percentage of few nodes", maxUnavailable: intstr.FromString("10%"), managed: 3, want: 1},
+		// skipped nodes aren't managed, so they don't scale the percentage.
+		{name: "percentage of managed nodes", maxUnavailable: intstr.FromString("50%"), managed: 4, want: 2},
+		{name: "percentage without nodes", maxUnavailable: intstr.FromString("50%"), managed: 0, want: 1},
+		{name: "invalid percentage", maxUnavailable: intstr.FromString("half"), managed: 10, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getMaxUnavailable(tt.maxUnavailable, tt.managed)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getMaxUnavailable() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("getMaxUnavailable() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+const testAgentTaint = "node.containerd-registrar.io/agent-not-ready"
+
+func newRolloutNode(name string) *corev1.Node {
+	return &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:            name,
+		ResourceVersion: "1",
+		Annotations:     map[string]string{nodeStateAnnotation: string(nodeStateReady)},
+	}}
+}
+
+func newRolloutAgentPod(ds *appsv1.DaemonSet, nodeName, revision string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "agent-" + nodeName,
+			Namespace: ds.Namespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/name":              "containerd-registrar-agent",
+				appsv1.DefaultDaemonSetUniqueLabelKey: revision,
+			},
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(ds, appsv1.SchemeGroupVersion.WithKind("DaemonSet"))},
+		},
+		Spec: corev1.PodSpec{NodeName: nodeName},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodRunning,
+			Conditions: []corev1.PodCondition{{
+				Type:               corev1.PodReady,
+				Status:             corev1.ConditionTrue,
+				LastTransitionTime: metav1.NewTime(time.Now().Add(-time.Hour)),
+			}},
+		},
+	}
+}
+
+func newRolloutRevision(ds *appsv1.DaemonSet, hash string, revision int64) *appsv1.ControllerRevision {
+	return &appsv1.ControllerRevision{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            ds.Name + "-" + hash,
+			Namespace:       ds.Namespace,
+			Labels:          map[string]string{appsv1.DefaultDaemonSetUniqueLabelKey: hash},
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(ds, appsv1.SchemeGroupVersion.WithKind("DaemonSet"))},
+		},
+		Revision: revision,
+	}
+}
+
+// waitForNode waits for the node informer to cache the node matching the
+// condition.
+func waitForNode(t *testing.T, mgr *Manager, name string, cond func(*corev1.Node) bool) {
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		obj, exists := getObjectFromStoreByKey(mgr.nodeInformer.GetStore(), name)
+		return exists && cond(obj.(*corev1.Node)), nil
+	})
+	if err != nil {
+		t.Fatalf("waiting for node %s: %s", name, err)
+	}
+}
+
+func TestSyncRolloutPausesOnFailedNode(t *testing.T) {
+	ds := &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "containerd-registrar-agent", Namespace: "kube-system", UID: "agent"},
+		Spec: appsv1.DaemonSetSpec{
+			UpdateStrategy: appsv1.DaemonSetUpdateStrategy{Type: appsv1.OnDeleteDaemonSetStrategyType},
+		},
+	}
+
+	objs := []runtime.Object{ds, newRolloutRevision(ds, "old", 1), newRolloutRevision(ds, "new", 2)}
+	for _, name := range []string{"node-a", "node-b", "node-c"} {
+		objs = append(objs, newRolloutNode(name), newRolloutAgentPod(ds, name, "old"))
+	}
+
+	client := fake.NewSimpleClientset(objs...)
+	mgr := NewManager(client, nil, Config{
+		AgentNodeTaint:        testAgentTaint,
+		AgentPodNamespace:     "kube-system",
+		AgentPodLabels:        "app.kubernetes.io/name=containerd-registrar-agent",
+		RolloutMaxUnavailable: intstr.FromInt(1),
+		RolloutReadyTimeout:   time.Hour,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mgr.factory.Start(ctx.Done())
+	for typ, synced := range mgr.factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			t.Fatalf("syncing %s informer cache", typ)
+		}
+	}
+
+	gated := func(node *corev1.Node) bool {
+		return hasTaintWithKey(node, testAgentTaint)
+	}
+
+	mgr.syncRollout(ctx)
+	waitForNode(t, mgr, "node-a", gated)
+
+	// the agent of the new revision fails to configure containerd.
+	node, err := client.CoreV1().Nodes().Get(ctx, "node-a", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("getting node: %s", err)
+	}
+	node.Annotations[result.Annotation] = string(result.ConfigInvalid)
+	if _, err := client.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("updating node: %s", err)
+	}
+	waitForNode(t, mgr, "node-a", func(node *corev1.Node) bool {
+		return mgr.getNodeState(node) == nodeStateFailed
+	})
+
+	mgr.syncRollout(ctx)
+	mgr.syncRollout(ctx)
+
+	if !mgr.rollout.paused {
+		t.Error("rollout isn't paused by failed node")
+	}
+
+	for _, name := range []string{"node-b", "node-c"} {
+		node, err := client.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("getting node: %s", err)
+		}
+		if gated(node) {
+			t.Errorf("node %s is gated, while updating node is failed", name)
+		}
+	}
+}
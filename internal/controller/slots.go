@@ -0,0 +1,41 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/xinau/containerd-registrar/internal/slots"
+)
+
+// syncRestartSlots observes the restart slots held by agents and reports
+// slots whose holder failed to release them.
+func (mgr *Manager) syncRestartSlots(ctx context.Context) {
+	now := time.Now()
+
+	var held, expired int
+	for _, obj := range mgr.leaseInformer.GetStore().List() {
+		lease := obj.(*coordinationv1.Lease)
+		if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity == "" {
+			continue
+		}
+
+		if slots.IsHeld(lease, now) {
+			held++
+			continue
+		}
+
+		expired++
+		logrus.WithFields(logrus.Fields{"lease": lease.Name, "holder": *lease.Spec.HolderIdentity}).Warn("restart slot expired without being released")
+	}
+
+	restartSlots.WithLabelValues("held").Set(float64(held))
+	restartSlots.WithLabelValues("expired").Set(float64(expired))
+}
+
+func (mgr *Manager) watchRestartSlots(ctx context.Context) {
+	wait.UntilWithContext(ctx, mgr.syncRestartSlots, mgr.cfg.ResyncInterval)
+}
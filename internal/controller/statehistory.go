@@ -0,0 +1,192 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+var nodeStateHistoryAnnotation = "node.containerd-registrar.io/node-state-history"
+
+// NodeStateTransition is an entry of a node's state history.
+type NodeStateTransition struct {
+	State     string    `json:"state"`
+	Reason    string    `json:"reason,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// getNodeStateHistory returns the state transitions recorded on the node,
+// oldest first. Malformed histories are ignored.
+func getNodeStateHistory(node *corev1.Node) []NodeStateTransition {
+	value, ok := node.Annotations[nodeStateHistoryAnnotation]
+	if !ok {
+		return nil
+	}
+
+	var history []NodeStateTransition
+	if err := json.Unmarshal([]byte(value), &history); err != nil {
+		return nil
+	}
+	return history
+}
+
+// appendNodeStateHistory appends the transition to the history, if the state
+// or reason changed, keeping at most limit entries. Truncated histories never
+// start with a ready transition, as it would be taken for the node's first.
+func appendNodeStateHistory(history []NodeStateTransition, transition NodeStateTransition, limit int) ([]NodeStateTransition, bool) {
+	if n := len(history); n > 0 && history[n-1].State == transition.State && history[n-1].Reason == transition.Reason {
+		return history, false
+	}
+
+	history = append(history, transition)
+	if len(history) > limit {
+		history = history[len(history)-limit:]
+		for len(history) > 0 && history[0].State == string(nodeStateReady) {
+			history = history[1:]
+		}
+	}
+	return history, true
+}
+
+// setNodeStateHistory records the transition into the state in the node's
+// state history annotation. The patch keeps the updated history, if the state
+// or reason changed. Unmanaged nodes registered with the agent taint have been
+// pending since their creation, which starts their history.
+func (mgr *Manager) setNodeStateHistory(np *nodePatch, state nodeState, reason string, now time.Time) {
+	if mgr.cfg.NodeStateHistoryLimit <= 0 {
+		return
+	}
+
+	history, registered := getNodeStateHistory(np.node), false
+	if _, managed := np.node.Annotations[nodeStateAnnotation]; !managed && len(history) == 0 && hasTaintWithKey(np.node, mgr.cfg.AgentNodeTaint) {
+		history = []NodeStateTransition{{
+			State:     string(nodeStatePending),
+			Timestamp: np.node.CreationTimestamp.UTC(),
+		}}
+		registered = true
+	}
+
+	history, changed := appendNodeStateHistory(history, NodeStateTransition{
+		State:     string(state),
+		Reason:    reason,
+		Timestamp: now,
+	}, mgr.cfg.NodeStateHistoryLimit)
+	if !changed && !registered {
+		return
+	}
+
+	payload, err := json.Marshal(history)
+	if err != nil {
+		return
+	}
+	np.setAnnotation(nodeStateHistoryAnnotation, string(payload))
+	np.history = history
+}
+
+// getTimeToReady returns the time the node took to become ready the last time
+// it was gated. The gating starts with the pending or failed transitions
+// preceding the last ready transition. Nodes without such transitions, e.g.
+// ready before the history was recorded, have no time to ready.
+func getTimeToReady(history []NodeStateTransition) (time.Duration, bool) {
+	ready := -1
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].State == string(nodeStateReady) {
+			ready = i
+			break
+		}
+	}
+
+	if ready < 0 {
+		return 0, false
+	}
+
+	start := -1
+	for i := ready - 1; i >= 0; i-- {
+		state := nodeState(history[i].State)
+		if state != nodeStatePending && state != nodeStateFailed {
+			break
+		}
+		start = i
+	}
+
+	if start < 0 {
+		return 0, false
+	}
+	return history[ready].Timestamp.Sub(history[start].Timestamp), true
+}
+
+// observeTimeToReady reports the time to ready of a node, which has been
+// marked as ready by the applied patch.
+func observeTimeToReady(np *nodePatch) {
+	if np.history == nil {
+		return
+	}
+
+	if d, ok := getTimeToReady(np.history); ok {
+		nodeTimeToReady.Observe(d.Seconds())
+	}
+}
+
+// NodeStatus is the registrar's state of a node.
+type NodeStatus struct {
+	Name        string
+	State       string
+	Reason      string
+	Since       time.Time
+	TimeToReady time.Duration
+	History     []NodeStateTransition
+}
+
+// ListNodeStatus returns the state of every node managed by the registrar or,
+// if name is set, of that node only.
+func ListNodeStatus(ctx context.Context, client kubernetes.Interface, name string) ([]*NodeStatus, error) {
+	var nodes []corev1.Node
+	if name != "" {
+		node, err := client.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, *node)
+	} else {
+		list, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		nodes = list.Items
+	}
+
+	var statuses []*NodeStatus
+	for i := range nodes {
+		node := &nodes[i]
+		state, ok := node.Annotations[nodeStateAnnotation]
+		if !ok {
+			if name != "" {
+				return nil, fmt.Errorf("node %s isn't managed by the registrar", name)
+			}
+			continue
+		}
+
+		status := &NodeStatus{
+			Name:    node.Name,
+			State:   state,
+			Reason:  node.Annotations[nodeStateReasonAnnotation],
+			Since:   getNodeStateTimestamp(node),
+			History: getNodeStateHistory(node),
+		}
+		if d, ok := getTimeToReady(status.History); ok {
+			status.TimeToReady = d
+		}
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses, nil
+}
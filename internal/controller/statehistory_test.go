@@ -0,0 +1,218 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func transition(state nodeState, reason string, ts time.Time) NodeStateTransition {
+	return NodeStateTransition{State: string(state), Reason: reason, Timestamp: ts}
+}
+
+func TestAppendNodeStateHistory(t *testing.T) {
+	t0 := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		history     []NodeStateTransition
+		transition  NodeStateTransition
+		limit       int
+		want        []NodeStateTransition
+		wantChanged bool
+	}{
+		{
+			name:        "empty history",
+			transition:  transition(nodeStatePending, "", t0),
+			limit:       3,
+			want:        []NodeStateTransition{transition(nodeStatePending, "", t0)},
+			wantChanged: true,
+		},
+		{
+			name:       "same state and reason",
+			history:    []NodeStateTransition{transition(nodeStatePending, "", t0)},
+			transition: transition(nodeStatePending, "", t0.Add(time.Minute)),
+			limit:      3,
+			want:       []NodeStateTransition{transition(nodeStatePending, "", t0)},
+		},
+		{
+			name:       "changed reason",
+			history:    []NodeStateTransition{transition(nodeStatePending, "", t0)},
+			transition: transition(nodeStatePending, reasonPendingTimeout, t0.Add(time.Minute)),
+			limit:      3,
+			want: []NodeStateTransition{
+				transition(nodeStatePending, "", t0),
+				transition(nodeStatePending, reasonPendingTimeout, t0.Add(time.Minute)),
+			},
+			wantChanged: true,
+		},
+		{
+			name: "truncated to limit",
+			history: []NodeStateTransition{
+				transition(nodeStatePending, "", t0),
+				transition(nodeStateFailed, "ConfigInvalid", t0.Add(time.Minute)),
+				transition(nodeStatePending, "", t0.Add(2*time.Minute)),
+			},
+			transition: transition(nodeStateReady, "", t0.Add(3*time.Minute)),
+			limit:      3,
+			want: []NodeStateTransition{
+				transition(nodeStateFailed, "ConfigInvalid", t0.Add(time.Minute)),
+				transition(nodeStatePending, "", t0.Add(2*time.Minute)),
+				transition(nodeStateReady, "", t0.Add(3*time.Minute)),
+			},
+			wantChanged: true,
+		},
+		{
+			name: "truncated history doesn't start with ready",
+			history: []NodeStateTransition{
+				transition(nodeStatePending, "", t0),
+				transition(nodeStateReady, "", t0.Add(time.Minute)),
+				transition(nodeStatePending, reasonNodeRebooted, t0.Add(2*time.Minute)),
+			},
+			transition: transition(nodeStateReady, "", t0.Add(3*time.Minute)),
+			limit:      3,
+			want: []NodeStateTransition{
+				transition(nodeStatePending, reasonNodeRebooted, t0.Add(2*time.Minute)),
+				transition(nodeStateReady, "", t0.Add(3*time.Minute)),
+			},
+			wantChanged: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, changed := appendNodeStateHistory(tt.history, tt.transition, tt.limit)
+			if changed != tt.wantChanged {
+				t.Errorf("appendNodeStateHistory() changed = %t, want %t", changed, tt.wantChanged)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("appendNodeStateHistory() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetTimeToReady(t *testing.T) {
+	t0 := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		history []NodeStateTransition
+		want    time.Duration
+		wantOK  bool
+	}{
+		{
+			name: "empty history",
+		},
+		{
+			name:    "never ready",
+			history: []NodeStateTransition{transition(nodeStatePending, "", t0)},
+		},
+		{
+			name: "pending to ready",
+			history: []NodeStateTransition{
+				transition(nodeStatePending, "", t0),
+				transition(nodeStateReady, "", t0.Add(30*time.Second)),
+			},
+			want:   30 * time.Second,
+			wantOK: true,
+		},
+		{
+			name: "failed before ready",
+			history: []NodeStateTransition{
+				transition(nodeStatePending, "", t0),
+				transition(nodeStateFailed, "RestartFailed", t0.Add(time.Minute)),
+				transition(nodeStatePending, reasonPendingTimeout, t0.Add(2*time.Minute)),
+				transition(nodeStateReady, "", t0.Add(3*time.Minute)),
+			},
+			want:   3 * time.Minute,
+			wantOK: true,
+		},
+		{
+			name: "last gating",
+			history: []NodeStateTransition{
+				transition(nodeStatePending, "", t0),
+				transition(nodeStateReady, "", t0.Add(time.Minute)),
+				transition(nodeStatePending, reasonNodeRebooted, t0.Add(time.Hour)),
+				transition(nodeStateReady, "", t0.Add(time.Hour+20*time.Second)),
+			},
+			want:   20 * time.Second,
+			wantOK: true,
+		},
+		{
+			name:    "ready before history",
+			history: []NodeStateTransition{transition(nodeStateReady, "", t0)},
+		},
+		{
+			name: "ready without gating",
+			history: []NodeStateTransition{
+				transition(nodeStateDegraded, reasonBreakGlass, t0),
+				transition(nodeStateReady, "", t0.Add(time.Minute)),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := getTimeToReady(tt.history)
+			if ok != tt.wantOK {
+				t.Fatalf("getTimeToReady() ok = %t, want %t", ok, tt.wantOK)
+			}
+			if got != tt.want {
+				t.Errorf("getTimeToReady() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetNodeStateHistory(t *testing.T) {
+	const key = "node.containerd-registrar.io/agent-not-ready"
+
+	t0 := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	created := metav1.NewTime(t0.Add(-time.Minute))
+	taints := []corev1.Taint{{Key: key, Value: "true", Effect: corev1.TaintEffectNoSchedule}}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		taints      []corev1.Taint
+		want        []NodeStateTransition
+	}{
+		{
+			name:   "registered with taint",
+			taints: taints,
+			want: []NodeStateTransition{
+				transition(nodeStatePending, "", created.Time),
+				transition(nodeStateReady, "", t0),
+			},
+		},
+		{
+			name: "registered without taint",
+			want: []NodeStateTransition{transition(nodeStateReady, "", t0)},
+		},
+		{
+			name:        "managed before history",
+			annotations: map[string]string{nodeStateAnnotation: string(nodeStatePending)},
+			taints:      taints,
+			want:        []NodeStateTransition{transition(nodeStateReady, "", t0)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := &Manager{cfg: Config{AgentNodeTaint: key, NodeStateHistoryLimit: 10}}
+			np := newNodePatch(&corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations, CreationTimestamp: created},
+				Spec:       corev1.NodeSpec{Taints: tt.taints},
+			})
+
+			mgr.setNodeStateHistory(np, nodeStateReady, "", t0)
+			if !reflect.DeepEqual(np.history, tt.want) {
+				t.Errorf("setNodeStateHistory() = %+v, want %+v", np.history, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+const reasonRegistrarTornDown = "RegistrarTornDown"
+
+// TeardownConfig holds the node state removed by Teardown.
+type TeardownConfig struct {
+	AgentNodeTaint string
+	NodeStateLabel string
+}
+
+// TeardownSummary counts the nodes handled by Teardown.
+type TeardownSummary struct {
+	Nodes    int
+	Released int
+	Failed   int
+}
+
+// isPatchConflict reports whether a node patch failed, because the node
+// changed since it was read. This is either reported as conflict or as
+// invalid patch due to the failing resource version test.
+func isPatchConflict(err error) bool {
+	return apierrors.IsConflict(err) || apierrors.IsInvalid(err)
+}
+
+// teardownNode removes the registrar's state from the node, retrying with a
+// fresh copy of the node if it changed in the meantime.
+func (mgr *Manager) teardownNode(ctx context.Context, name string) error {
+	return retry.OnError(retry.DefaultRetry, isPatchConflict, func() error {
+		node, err := mgr.client.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		return mgr.removeRegistrarState(ctx, node)
+	})
+}
+
+// Teardown removes the registrar's taint, annotations, label and condition
+// from every node in the cluster. With dryRun set, nodes are only reported.
+// It only needs the client, so it runs without the controller's informers.
+func Teardown(ctx context.Context, client kubernetes.Interface, cfg TeardownConfig, dryRun bool) (TeardownSummary, error) {
+	var summary TeardownSummary
+
+	broadcaster, recorder := newEventRecorder()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+		Interface: client.CoreV1().Events(""),
+	})
+	defer broadcaster.Shutdown()
+
+	mgr := &Manager{
+		client: client,
+		cfg: Config{
+			AgentNodeTaint: cfg.AgentNodeTaint,
+			NodeStateLabel: cfg.NodeStateLabel,
+		},
+		recorder: recorder,
+	}
+
+	nodes, err := mgr.client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return summary, err
+	}
+
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		summary.Nodes++
+		if !mgr.hasRegistrarState(node) {
+			continue
+		}
+
+		logfields := logrus.Fields{"node": node.Name, "dry-run": dryRun}
+		logrus.WithFields(logfields).Info("removing registrar state from node")
+		if dryRun {
+			summary.Released++
+			continue
+		}
+
+		if err := mgr.teardownNode(ctx, node.Name); err != nil {
+			logrus.WithFields(logfields).WithError(err).Warn("failed removing registrar state from node")
+			summary.Failed++
+			continue
+		}
+
+		mgr.recorder.Event(node, corev1.EventTypeNormal, reasonRegistrarTornDown, "Removed registrar state from node during teardown")
+		summary.Released++
+	}
+
+	return summary, nil
+}
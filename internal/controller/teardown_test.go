@@ -0,0 +1,53 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestTeardown(t *testing.T) {
+	cfg := TeardownConfig{
+		AgentNodeTaint: "node.containerd-registrar.io/agent-not-ready",
+		NodeStateLabel: "node.containerd-registrar.io/node-state",
+	}
+
+	client := fake.NewSimpleClientset(
+		&corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "managed",
+				ResourceVersion: "1",
+				Annotations: map[string]string{
+					managedByAnnotation: managedByValue,
+					nodeStateAnnotation: string(nodeStatePending),
+				},
+				Labels: map[string]string{cfg.NodeStateLabel: string(nodeStatePending)},
+			},
+			Spec: corev1.NodeSpec{Taints: []corev1.Taint{
+				{Key: cfg.AgentNodeTaint, Value: "true", Effect: corev1.TaintEffectNoSchedule},
+			}},
+		},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "unmanaged", ResourceVersion: "1"}},
+	)
+
+	ctx := context.Background()
+	summary, err := Teardown(ctx, client, cfg, false)
+	if err != nil {
+		t.Fatalf("Teardown() error = %s", err)
+	}
+	if want := (TeardownSummary{Nodes: 2, Released: 1}); summary != want {
+		t.Errorf("Teardown() = %+v, want %+v", summary, want)
+	}
+
+	node, err := client.CoreV1().Nodes().Get(ctx, "managed", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("getting node: %s", err)
+	}
+	mgr := &Manager{cfg: Config{AgentNodeTaint: cfg.AgentNodeTaint, NodeStateLabel: cfg.NodeStateLabel}}
+	if mgr.hasRegistrarState(node) {
+		t.Errorf("node still has registrar state: %+v", node)
+	}
+}
@@ -0,0 +1,90 @@
+package controller
+
+import (
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/tools/cache"
+)
+
+// notTerminatedPodsFieldSelector excludes pods which won't run again from the
+// agent pod informer.
+var notTerminatedPodsFieldSelector = "status.phase!=Succeeded,status.phase!=Failed"
+
+// stripManagedFields removes the managed fields, which are never used by the
+// controller, but make up a large share of most objects.
+func stripManagedFields(obj interface{}) (interface{}, error) {
+	if accessor, err := meta.Accessor(obj); err == nil {
+		accessor.SetManagedFields(nil)
+	}
+	return obj, nil
+}
+
+// transformNode strips the node down to the fields used by the state machine:
+// its metadata, taints, boot ID and the registrar's condition. Image lists,
+// volumes and the other conditions are dropped.
+func transformNode(obj interface{}) (interface{}, error) {
+	node, ok := obj.(*corev1.Node)
+	if !ok {
+		return stripManagedFields(obj)
+	}
+
+	node.ManagedFields = nil
+	node.Spec = corev1.NodeSpec{
+		Taints:        node.Spec.Taints,
+		Unschedulable: node.Spec.Unschedulable,
+	}
+
+	var conditions []corev1.NodeCondition
+	if cond := getNodeCondition(node, nodeConditionType); cond != nil {
+		conditions = []corev1.NodeCondition{*cond}
+	}
+	node.Status = corev1.NodeStatus{
+		Conditions: conditions,
+		NodeInfo:   corev1.NodeSystemInfo{BootID: node.Status.NodeInfo.BootID},
+	}
+
+	return node, nil
+}
+
+// transformContainerStatuses strips the container statuses down to their
+// waiting state.
+func transformContainerStatuses(statuses []corev1.ContainerStatus) []corev1.ContainerStatus {
+	var tmp []corev1.ContainerStatus
+	for _, status := range statuses {
+		tmp = append(tmp, corev1.ContainerStatus{
+			Name:  status.Name,
+			State: corev1.ContainerState{Waiting: status.State.Waiting},
+		})
+	}
+	return tmp
+}
+
+// transformPod strips the agent pod down to its metadata, node, readiness and
+// the waiting state of its containers.
+func transformPod(obj interface{}) (interface{}, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return stripManagedFields(obj)
+	}
+
+	pod.ManagedFields = nil
+	pod.Spec = corev1.PodSpec{NodeName: pod.Spec.NodeName}
+	pod.Status = corev1.PodStatus{
+		Phase:                 pod.Status.Phase,
+		Conditions:            pod.Status.Conditions,
+		StartTime:             pod.Status.StartTime,
+		InitContainerStatuses: transformContainerStatuses(pod.Status.InitContainerStatuses),
+		ContainerStatuses:     transformContainerStatuses(pod.Status.ContainerStatuses),
+	}
+
+	return pod, nil
+}
+
+// setTransform sets the informer's transform, which is applied before objects
+// are stored in its cache. Without it the informer caches complete objects.
+func setTransform(informer cache.SharedIndexInformer, transform cache.TransformFunc) {
+	if err := informer.SetTransform(transform); err != nil {
+		logrus.WithError(err).Warn("failed setting informer transform")
+	}
+}
@@ -3,6 +3,7 @@ package flags
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/sirupsen/logrus"
@@ -129,3 +130,35 @@ func (lvl *LogLevel) String() string {
 	tmp := logrus.Level(*lvl)
 	return tmp.String()
 }
+
+type IntOrPercent string
+
+func NewIntOrPercent(str string) *IntOrPercent {
+	tmp := IntOrPercent(str)
+	return &tmp
+}
+
+func (iop *IntOrPercent) Get() any {
+	return string(*iop)
+}
+
+func (iop *IntOrPercent) Set(str string) error {
+	str = strings.TrimSpace(str)
+
+	num := strings.TrimSuffix(str, "%")
+	val, err := strconv.Atoi(num)
+	if err != nil {
+		return fmt.Errorf("(%q) isn't an integer or percentage", str)
+	}
+
+	if val < 0 {
+		return fmt.Errorf("(%q) mustn't be negative", str)
+	}
+
+	*iop = IntOrPercent(str)
+	return nil
+}
+
+func (iop *IntOrPercent) String() string {
+	return string(*iop)
+}
@@ -0,0 +1,43 @@
+package flags
+
+import "testing"
+
+func TestIntOrPercentSet(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "1", want: "1"},
+		{value: "0", want: "0"},
+		{value: "25%", want: "25%"},
+		{value: " 10% ", want: "10%"},
+		{value: "", wantErr: true},
+		{value: "%", wantErr: true},
+		{value: "ten", wantErr: true},
+		{value: "1.5", wantErr: true},
+		{value: "-1", wantErr: true},
+		{value: "-10%", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			iop := NewIntOrPercent("1")
+			err := iop.Set(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Set(%q) error = %v, wantErr %t", tt.value, err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				if got := iop.String(); got != "1" {
+					t.Errorf("Set(%q) changed value to %q on error", tt.value, got)
+				}
+				return
+			}
+
+			if got := iop.String(); got != tt.want {
+				t.Errorf("Set(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
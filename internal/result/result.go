@@ -0,0 +1,66 @@
+package result
+
+import (
+	"context"
+	"encoding/json"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apitypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// Annotation holds the result of the agent's last run on a node.
+	Annotation = "node.containerd-registrar.io/agent-result"
+
+	// MessageAnnotation holds a short message describing the result.
+	MessageAnnotation = "node.containerd-registrar.io/agent-result-message"
+)
+
+type Result string
+
+const (
+	Success       Result = "success"
+	ConfigInvalid Result = "config-invalid"
+	RestartFailed Result = "restart-failed"
+	RolledBack    Result = "rolled-back"
+)
+
+// Reason returns the result as reason in CamelCase as used by conditions and
+// events.
+func (r Result) Reason() string {
+	switch r {
+	case Success:
+		return "Success"
+	case ConfigInvalid:
+		return "ConfigInvalid"
+	case RestartFailed:
+		return "RestartFailed"
+	case RolledBack:
+		return "RolledBack"
+	}
+	return "Unknown"
+}
+
+// IsFailed reports whether the agent failed to configure containerd.
+func (r Result) IsFailed() bool {
+	return r == ConfigInvalid || r == RestartFailed
+}
+
+// Report writes the result onto the node's annotations.
+func Report(ctx context.Context, client kubernetes.Interface, nodeName string, result Result, message string) error {
+	payload, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				Annotation:        string(result),
+				MessageAnnotation: message,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.CoreV1().Nodes().Patch(ctx, nodeName, apitypes.MergePatchType, payload, metav1.PatchOptions{})
+	return err
+}
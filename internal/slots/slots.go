@@ -0,0 +1,229 @@
+package slots
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// LabelSelector matches the Leases used as restart slots.
+	LabelSelector = "app.kubernetes.io/part-of=containerd-registrar,app.kubernetes.io/component=restart-slot"
+
+	namePrefix = "containerd-registrar-restart-slot-"
+)
+
+var retryInterval = 5 * time.Second
+
+func leaseLabels() map[string]string {
+	return map[string]string{
+		"app.kubernetes.io/part-of":   "containerd-registrar",
+		"app.kubernetes.io/component": "restart-slot",
+	}
+}
+
+// IsExpired reports whether the Lease's holder failed to renew it within the
+// lease duration.
+func IsExpired(lease *coordinationv1.Lease, now time.Time) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+
+	duration := time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+	return lease.Spec.RenewTime.Add(duration).Before(now)
+}
+
+// IsHeld reports whether the Lease is held by any holder.
+func IsHeld(lease *coordinationv1.Lease, now time.Time) bool {
+	return lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity != "" && !IsExpired(lease, now)
+}
+
+// Slots limits the number of concurrent containerd restarts across the
+// cluster using a fixed number of Leases.
+type Slots struct {
+	client    kubernetes.Interface
+	namespace string
+	holder    string
+	count     int
+	duration  time.Duration
+}
+
+func New(client kubernetes.Interface, namespace, holder string, count int, duration time.Duration) *Slots {
+	return &Slots{
+		client:    client,
+		namespace: namespace,
+		holder:    holder,
+		count:     count,
+		duration:  duration,
+	}
+}
+
+// Slot is a restart slot held until being released.
+type Slot struct {
+	slots *Slots
+	name  string
+	stop  context.CancelFunc
+	done  chan struct{}
+}
+
+func (s *Slots) tryAcquire(ctx context.Context, name string) (bool, error) {
+	now := metav1.NewMicroTime(time.Now())
+	duration := int32(s.duration.Seconds())
+
+	lease, err := s.client.CoordinationV1().Leases(s.namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		lease := &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: s.namespace,
+				Labels:    leaseLabels(),
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &s.holder,
+				LeaseDurationSeconds: &duration,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+
+		_, err := s.client.CoordinationV1().Leases(s.namespace).Create(ctx, lease, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	holder := lease.Spec.HolderIdentity
+	if IsHeld(lease, now.Time) && *holder != s.holder {
+		return false, nil
+	}
+
+	transitions := int32(1)
+	if lease.Spec.LeaseTransitions != nil {
+		transitions += *lease.Spec.LeaseTransitions
+	}
+
+	lease.Spec = coordinationv1.LeaseSpec{
+		HolderIdentity:       &s.holder,
+		LeaseDurationSeconds: &duration,
+		AcquireTime:          &now,
+		RenewTime:            &now,
+		LeaseTransitions:     &transitions,
+	}
+
+	// the update fails with a conflict, if another holder acquired the slot
+	// in the meantime.
+	_, err = s.client.CoordinationV1().Leases(s.namespace).Update(ctx, lease, metav1.UpdateOptions{})
+	if apierrors.IsConflict(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *Slots) renew(ctx context.Context, name string) error {
+	lease, err := s.client.CoordinationV1().Leases(s.namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != s.holder {
+		return fmt.Errorf("lease %q is held by another holder", name)
+	}
+
+	now := metav1.NewMicroTime(time.Now())
+	lease.Spec.RenewTime = &now
+
+	_, err = s.client.CoordinationV1().Leases(s.namespace).Update(ctx, lease, metav1.UpdateOptions{})
+	return err
+}
+
+// Acquire blocks until one of the restart slots is acquired or the context
+// is done. The acquired slot is renewed until it's released.
+func (s *Slots) Acquire(ctx context.Context) (*Slot, error) {
+	for {
+		for i := 0; i < s.count; i++ {
+			name := fmt.Sprintf("%s%d", namePrefix, i)
+			ok, err := s.tryAcquire(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+
+			if ok {
+				return s.hold(ctx, name), nil
+			}
+		}
+
+		logrus.WithField("slots", s.count).Debug("all restart slots are held, waiting")
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+func (s *Slots) hold(ctx context.Context, name string) *Slot {
+	ctx, cancel := context.WithCancel(ctx)
+	slot := &Slot{
+		slots: s,
+		name:  name,
+		stop:  cancel,
+		done:  make(chan struct{}),
+	}
+
+	go func() {
+		defer close(slot.done)
+
+		ticker := time.NewTicker(s.duration / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.renew(ctx, name); err != nil && ctx.Err() == nil {
+					logrus.WithField("lease", name).WithError(err).Warn("renewing restart slot")
+				}
+			}
+		}
+	}()
+
+	return slot
+}
+
+func (slot *Slot) Name() string {
+	return slot.name
+}
+
+// Release stops renewing the slot and frees it for other holders.
+func (slot *Slot) Release(ctx context.Context) error {
+	slot.stop()
+	<-slot.done
+
+	s := slot.slots
+	lease, err := s.client.CoordinationV1().Leases(s.namespace).Get(ctx, slot.name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != s.holder {
+		return nil
+	}
+
+	lease.Spec.HolderIdentity = nil
+	lease.Spec.AcquireTime = nil
+	lease.Spec.RenewTime = nil
+
+	_, err = s.client.CoordinationV1().Leases(s.namespace).Update(ctx, lease, metav1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,163 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// maxRequestSize limits the size of admission reviews read from requests.
+const maxRequestSize = 3 << 20
+
+type Config struct {
+	// TaintKey is the key of the agent taint tolerated regardless of its
+	// value and effect.
+	TaintKey string
+
+	// Namespaces, PriorityClasses and DaemonSets select the pods getting the
+	// toleration. DaemonSets are given as namespace/name or * matching all
+	// DaemonSets.
+	Namespaces      []string
+	PriorityClasses []string
+	DaemonSets      []string
+}
+
+type patch struct {
+	OP    string      `json:"op,omitempty"`
+	Path  string      `json:"path,omitempty"`
+	Value interface{} `json:"value"`
+}
+
+// Handler is a mutating admission webhook adding the agent taint's toleration
+// to selected pods, so they can start on nodes gated by the controller.
+type Handler struct {
+	cfg Config
+}
+
+func NewHandler(cfg Config) *Handler {
+	return &Handler{cfg: cfg}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// isSelected reports whether the pod is selected by namespace, priority class
+// or owning DaemonSet.
+func (h *Handler) isSelected(pod *corev1.Pod, namespace string) bool {
+	if contains(h.cfg.Namespaces, namespace) {
+		return true
+	}
+
+	if pod.Spec.PriorityClassName != "" && contains(h.cfg.PriorityClasses, pod.Spec.PriorityClassName) {
+		return true
+	}
+
+	ref := metav1.GetControllerOf(pod)
+	if ref == nil || ref.Kind != "DaemonSet" {
+		return false
+	}
+	return contains(h.cfg.DaemonSets, "*") || contains(h.cfg.DaemonSets, namespace+"/"+ref.Name)
+}
+
+// isTolerated reports whether the pod tolerates the taint regardless of its
+// effect.
+func (h *Handler) isTolerated(pod *corev1.Pod) bool {
+	for _, toleration := range pod.Spec.Tolerations {
+		if toleration.Operator == corev1.TolerationOpExists && (toleration.Key == "" || toleration.Key == h.cfg.TaintKey) && toleration.Effect == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// mutate returns the JSON patch adding the toleration to the pod or nil, if
+// the pod isn't selected or already tolerates the taint.
+func (h *Handler) mutate(req *admissionv1.AdmissionRequest) ([]patch, error) {
+	var pod corev1.Pod
+	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+		return nil, fmt.Errorf("decoding pod: %s", err)
+	}
+
+	if !h.isSelected(&pod, req.Namespace) || h.isTolerated(&pod) {
+		return nil, nil
+	}
+
+	toleration := corev1.Toleration{
+		Key:      h.cfg.TaintKey,
+		Operator: corev1.TolerationOpExists,
+	}
+
+	if len(pod.Spec.Tolerations) == 0 {
+		return []patch{{OP: "add", Path: "/spec/tolerations", Value: []corev1.Toleration{toleration}}}, nil
+	}
+	return []patch{{OP: "add", Path: "/spec/tolerations/-", Value: toleration}}, nil
+}
+
+func (h *Handler) review(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	resp := &admissionv1.AdmissionResponse{UID: req.UID, Allowed: true}
+	if req.Kind.Kind != "Pod" || req.Operation != admissionv1.Create {
+		return resp
+	}
+
+	patches, err := h.mutate(req)
+	if err != nil {
+		// pods are admitted unchanged, as the webhook mustn't block pods.
+		logrus.WithFields(logrus.Fields{"namespace": req.Namespace, "name": req.Name}).WithError(err).Warn("mutating pod")
+		return resp
+	}
+
+	if patches == nil {
+		return resp
+	}
+
+	payload, err := json.Marshal(patches)
+	if err != nil {
+		return resp
+	}
+
+	pt := admissionv1.PatchTypeJSONPatch
+	resp.Patch = payload
+	resp.PatchType = &pt
+
+	logrus.WithFields(logrus.Fields{"namespace": req.Namespace, "name": req.Name}).Debug("adding agent taint toleration to pod")
+	return resp
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestSize))
+	if err != nil {
+		http.Error(w, "reading request", http.StatusBadRequest)
+		return
+	}
+
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		http.Error(w, "decoding admission review", http.StatusBadRequest)
+		return
+	}
+
+	review.Response = h.review(review.Request)
+	review.Request = nil
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&review); err != nil {
+		logrus.WithError(err).Warn("writing admission review")
+	}
+}
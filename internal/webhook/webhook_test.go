@@ -0,0 +1,133 @@
+package webhook
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func newRequest(t *testing.T, namespace string, pod *corev1.Pod) *admissionv1.AdmissionRequest {
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatalf("encoding pod: %s", err)
+	}
+
+	return &admissionv1.AdmissionRequest{
+		Namespace: namespace,
+		Object:    runtime.RawExtension{Raw: raw},
+	}
+}
+
+func TestMutate(t *testing.T) {
+	const key = "node.containerd-registrar.io/agent-not-ready"
+
+	toleration := corev1.Toleration{Key: key, Operator: corev1.TolerationOpExists}
+	isController := true
+	daemonSetRef := metav1.OwnerReference{Kind: "DaemonSet", Name: "cilium", Controller: &isController}
+
+	tests := []struct {
+		name      string
+		cfg       Config
+		namespace string
+		pod       *corev1.Pod
+		want      []patch
+	}{
+		{
+			name:      "not selected",
+			cfg:       Config{Namespaces: []string{"kube-system"}},
+			namespace: "default",
+			pod:       &corev1.Pod{},
+		},
+		{
+			name:      "selected by namespace",
+			cfg:       Config{Namespaces: []string{"kube-system"}},
+			namespace: "kube-system",
+			pod:       &corev1.Pod{},
+			want:      []patch{{OP: "add", Path: "/spec/tolerations", Value: []corev1.Toleration{toleration}}},
+		},
+		{
+			name:      "selected by priority class",
+			cfg:       Config{PriorityClasses: []string{"system-node-critical"}},
+			namespace: "default",
+			pod:       &corev1.Pod{Spec: corev1.PodSpec{PriorityClassName: "system-node-critical"}},
+			want:      []patch{{OP: "add", Path: "/spec/tolerations", Value: []corev1.Toleration{toleration}}},
+		},
+		{
+			name:      "selected by daemonset",
+			cfg:       Config{DaemonSets: []string{"kube-system/cilium"}},
+			namespace: "kube-system",
+			pod:       &corev1.Pod{ObjectMeta: metav1.ObjectMeta{OwnerReferences: []metav1.OwnerReference{daemonSetRef}}},
+			want:      []patch{{OP: "add", Path: "/spec/tolerations", Value: []corev1.Toleration{toleration}}},
+		},
+		{
+			name:      "selected by any daemonset",
+			cfg:       Config{DaemonSets: []string{"*"}},
+			namespace: "default",
+			pod:       &corev1.Pod{ObjectMeta: metav1.ObjectMeta{OwnerReferences: []metav1.OwnerReference{daemonSetRef}}},
+			want:      []patch{{OP: "add", Path: "/spec/tolerations", Value: []corev1.Toleration{toleration}}},
+		},
+		{
+			name:      "daemonset in other namespace",
+			cfg:       Config{DaemonSets: []string{"kube-system/cilium"}},
+			namespace: "default",
+			pod:       &corev1.Pod{ObjectMeta: metav1.ObjectMeta{OwnerReferences: []metav1.OwnerReference{daemonSetRef}}},
+		},
+		{
+			name:      "appended to existing tolerations",
+			cfg:       Config{Namespaces: []string{"kube-system"}},
+			namespace: "kube-system",
+			pod: &corev1.Pod{Spec: corev1.PodSpec{Tolerations: []corev1.Toleration{
+				{Key: "node.kubernetes.io/not-ready", Operator: corev1.TolerationOpExists},
+			}}},
+			want: []patch{{OP: "add", Path: "/spec/tolerations/-", Value: toleration}},
+		},
+		{
+			name:      "already tolerated",
+			cfg:       Config{Namespaces: []string{"kube-system"}},
+			namespace: "kube-system",
+			pod:       &corev1.Pod{Spec: corev1.PodSpec{Tolerations: []corev1.Toleration{toleration}}},
+		},
+		{
+			name:      "tolerating everything",
+			cfg:       Config{Namespaces: []string{"kube-system"}},
+			namespace: "kube-system",
+			pod: &corev1.Pod{Spec: corev1.PodSpec{Tolerations: []corev1.Toleration{
+				{Operator: corev1.TolerationOpExists},
+			}}},
+		},
+		{
+			name:      "tolerating a single effect",
+			cfg:       Config{Namespaces: []string{"kube-system"}},
+			namespace: "kube-system",
+			pod: &corev1.Pod{Spec: corev1.PodSpec{Tolerations: []corev1.Toleration{
+				{Key: key, Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoSchedule},
+			}}},
+			want: []patch{{OP: "add", Path: "/spec/tolerations/-", Value: toleration}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.TaintKey = key
+			got, err := NewHandler(tt.cfg).mutate(newRequest(t, tt.namespace, tt.pod))
+			if err != nil {
+				t.Fatalf("mutate() error = %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mutate() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMutateInvalidPod(t *testing.T) {
+	req := &admissionv1.AdmissionRequest{Object: runtime.RawExtension{Raw: []byte("{")}}
+	if _, err := NewHandler(Config{}).mutate(req); err == nil {
+		t.Error("mutate() error = nil, want error")
+	}
+}